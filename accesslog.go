@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xjdrew/glog"
+)
+
+const accessLogTimeFormat = "20060102-150405.000"
+
+// AccessLogOption .
+type AccessLogOption struct {
+	File           string // empty means disabled
+	MaxSize        int    // MB, rotate if size of file exceeds it, 0 means unlimited
+	RotateInterval int    // seconds, rotate periodically, 0 means never
+	MaxBackups     int    // count of rotated files to keep, 0 means keep all
+}
+
+// AccessRecord is written to access log when a session is closed
+type AccessRecord struct {
+	Time         time.Time `json:"time"`
+	ID           int       `json:"id"`
+	ClientIPs    []string  `json:"client_ips"` // distinct ips across reuses, in order
+	ClientAddr   string    `json:"client_addr"`
+	Transport    string    `json:"transport"`
+	TargetServer string    `json:"target_server"`
+	Host         string    `json:"host"`
+	UpstreamAddr string    `json:"upstream_addr"`
+	CreatedAt    time.Time `json:"created_at"`
+	Duration     float64   `json:"duration"`     // seconds from created to closed
+	ConnectTime  float64   `json:"connect_time"` // seconds to connect upstream
+	C2SBytes     int64     `json:"c2s_bytes"`
+	C2SPackets   int64     `json:"c2s_packets"`
+	S2CBytes     int64     `json:"s2c_bytes"`
+	S2CPackets   int64     `json:"s2c_packets"`
+	Reuses       int64     `json:"reuses"`
+	CloseReason  string    `json:"close_reason"`
+	ClientBreak  string    `json:"client_break,omitempty"` // reason of the last broken client conn
+}
+
+// accessLogger writes records in json lines, rotates file by size and time
+type accessLogger struct {
+	mu     sync.Mutex
+	option AccessLogOption
+	file   *os.File
+	size   int64
+	openAt time.Time
+}
+
+var accessLog = &accessLogger{}
+
+func (l *accessLogger) open() error {
+	f, err := os.OpenFile(l.option.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = fi.Size()
+	l.openAt = time.Now()
+	return nil
+}
+
+func (l *accessLogger) close() {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// SetOption applies option, reopens file if it's changed
+func (l *accessLogger) SetOption(option *AccessLogOption) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if option.File == l.option.File {
+		l.option = *option
+		return nil
+	}
+
+	l.close()
+	l.option = *option
+	if option.File == "" {
+		return nil
+	}
+	return l.open()
+}
+
+func (l *accessLogger) shouldRotate(n int) bool {
+	if l.size == 0 {
+		return false
+	}
+	if l.option.MaxSize > 0 && l.size+int64(n) > int64(l.option.MaxSize)<<20 {
+		return true
+	}
+	if l.option.RotateInterval > 0 && time.Since(l.openAt) >= time.Duration(l.option.RotateInterval)*time.Second {
+		return true
+	}
+	return false
+}
+
+func (l *accessLogger) rotate() error {
+	l.close()
+	backup := l.option.File + "." + time.Now().Format(accessLogTimeFormat)
+	if err := os.Rename(l.option.File, backup); err != nil && !os.IsNotExist(err) {
+		glog.Errorf("rotate access log failed: file=%s, err=%s", l.option.File, err.Error())
+	}
+	if l.option.MaxBackups > 0 {
+		// backups are sorted by time in name
+		backups, _ := filepath.Glob(l.option.File + ".*")
+		sort.Strings(backups)
+		for len(backups) > l.option.MaxBackups {
+			os.Remove(backups[0])
+			backups = backups[1:]
+		}
+	}
+	return l.open()
+}
+
+// Log writes record to file, does nothing if access log is disabled
+func (l *accessLogger) Log(record *AccessRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.option.File == "" {
+		return
+	}
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		glog.Errorf("marshal access record failed: id=%d, err=%s", record.ID, err.Error())
+		return
+	}
+	b = append(b, '\n')
+
+	if l.file == nil {
+		err = l.open()
+	} else if l.shouldRotate(len(b)) {
+		err = l.rotate()
+	}
+	if err != nil {
+		glog.Errorf("open access log failed: file=%s, err=%s", l.option.File, err.Error())
+		return
+	}
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		glog.Errorf("write access log failed: file=%s, err=%s", l.option.File, err.Error())
+	}
+}
+
+// addClientIP records ip of client if it's not seen before
+func (p *connPair) addClientIP(addr net.Addr) {
+	ip := ipOf(addr)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, v := range p.clientIPs {
+		if v == ip {
+			return
+		}
+	}
+	p.clientIPs = append(p.clientIPs, ip)
+}
+
+func (p *connPair) accessRecord(reason string, now time.Time) *AccessRecord {
+	scon := p.RemoteConn.Current()
+	record := &AccessRecord{
+		Time:         now,
+		ID:           scon.ID(),
+		ClientAddr:   scon.RemoteAddr().String(),
+		Transport:    transportOf(scon.RawConn()),
+		TargetServer: scon.TargetServer(),
+		CreatedAt:    p.createdAt,
+		Duration:     now.Sub(p.createdAt).Seconds(),
+		C2SBytes:     atomic.LoadInt64(&p.c2sBytes),
+		C2SPackets:   atomic.LoadInt64(&p.c2sPackets),
+		S2CBytes:     atomic.LoadInt64(&p.s2cBytes),
+		S2CPackets:   atomic.LoadInt64(&p.s2cPackets),
+		Reuses:       atomic.LoadInt64(&p.reuses),
+		CloseReason:  reason,
+		ClientBreak:  p.RemoteConn.BreakReason(),
+	}
+
+	p.mutex.Lock()
+	record.ClientIPs = append([]string(nil), p.clientIPs...)
+	p.mutex.Unlock()
+
+	if p.LocalConn != nil {
+		record.Host = p.Host.Name
+		record.UpstreamAddr = p.LocalConn.RemoteAddr().String()
+		record.ConnectTime = p.connectedAt.Sub(p.createdAt).Seconds()
+	}
+	return record
+}
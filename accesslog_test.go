@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ejoy/goscon/scp"
+	"github.com/ejoy/goscon/upstream"
+)
+
+func TestAccessLogShouldRotate(t *testing.T) {
+	cases := []struct {
+		size           int64
+		n              int
+		maxSize        int
+		rotateInterval int
+		age            time.Duration
+		rotate         bool
+	}{
+		// empty file is never rotated
+		{0, 2 << 20, 1, 1, time.Hour, false},
+		{1 << 19, 1 << 19, 1, 0, 0, false},
+		{1 << 19, 1<<19 + 1, 1, 0, 0, true},
+		{1 << 30, 1, 0, 0, time.Hour, false},
+		{1, 1, 0, 60, 59 * time.Second, false},
+		{1, 1, 0, 60, 60 * time.Second, true},
+		{1, 1, 1, 60, 60 * time.Second, true},
+	}
+	for i, c := range cases {
+		l := &accessLogger{
+			option: AccessLogOption{MaxSize: c.maxSize, RotateInterval: c.rotateInterval},
+			size:   c.size,
+			openAt: time.Now().Add(-c.age),
+		}
+		if rotate := l.shouldRotate(c.n); rotate != c.rotate {
+			t.Errorf("case %d: rotate=%v", i, rotate)
+		}
+	}
+}
+
+// readAccessRecords reads json lines of file
+func readAccessRecords(t *testing.T, path string) []*AccessRecord {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []*AccessRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record AccessRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("%s: %s", path, err.Error())
+		}
+		records = append(records, &record)
+	}
+	return records
+}
+
+func TestAccessLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goscon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	l := &accessLogger{}
+	if err := l.SetOption(&AccessLogOption{File: path, MaxSize: 1, MaxBackups: 2}); err != nil {
+		t.Fatal(err)
+	}
+	defer l.SetOption(&AccessLogOption{})
+
+	for i := 1; i <= 5; i++ {
+		if i > 1 {
+			// full, rotate on next record; backups are named by milliseconds
+			l.size = 1 << 20
+			time.Sleep(2 * time.Millisecond)
+		}
+		l.Log(&AccessRecord{ID: i})
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("backups: %v", backups)
+	}
+	// the oldest backups are removed
+	for i, file := range append(backups, path) {
+		records := readAccessRecords(t, file)
+		if len(records) != 1 || records[0].ID != i+3 {
+			t.Errorf("%s: %d records", file, len(records))
+		}
+	}
+
+	// disabled
+	l.SetOption(&AccessLogOption{})
+	l.Log(&AccessRecord{ID: 6})
+	if records := readAccessRecords(t, path); len(records) != 1 {
+		t.Errorf("logged when disabled: %d records", len(records))
+	}
+}
+
+func TestAccessRecord(t *testing.T) {
+	c1, _ := net.Pipe()
+	c2, _ := net.Pipe()
+	createdAt := time.Now().Add(-10 * time.Second)
+	pair := &connPair{
+		RemoteConn:  NewSCPConn(scp.Restore(c1, &scp.Config{}, &scp.State{ID: 7, TargetServer: "game"})),
+		LocalConn:   c2,
+		Host:        &upstream.Host{Name: "game1", Addr: "127.0.0.1:11000"},
+		createdAt:   createdAt,
+		connectedAt: createdAt.Add(time.Second),
+		c2sBytes:    100,
+		c2sPackets:  2,
+		s2cBytes:    200,
+		s2cPackets:  3,
+		reuses:      2,
+	}
+	for _, addr := range []string{"10.0.0.1:1000", "10.0.0.2:1000", "10.0.0.1:1001"} {
+		a, _ := net.ResolveTCPAddr("tcp", addr)
+		pair.addClientIP(a)
+	}
+
+	now := createdAt.Add(30 * time.Second)
+	record := pair.accessRecord(reasonShutdown, now)
+	cases := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"id", record.ID, 7},
+		{"time", record.Time, now},
+		{"target_server", record.TargetServer, "game"},
+		{"client_ips", len(record.ClientIPs), 2},
+		{"host", record.Host, "game1"},
+		{"duration", record.Duration, 30.0},
+		{"connect_time", record.ConnectTime, 1.0},
+		{"c2s_bytes", record.C2SBytes, int64(100)},
+		{"s2c_packets", record.S2CPackets, int64(3)},
+		{"reuses", record.Reuses, int64(2)},
+		{"close_reason", record.CloseReason, reasonShutdown},
+	}
+	for _, c := range cases {
+		if c.got != c.want {
+			t.Errorf("%s: %v, want %v", c.name, c.got, c.want)
+		}
+	}
+	if record.ClientIPs[0] != "10.0.0.1" || record.ClientIPs[1] != "10.0.0.2" {
+		t.Errorf("client_ips: %v", record.ClientIPs)
+	}
+
+	// upstream fields are absent if not connected
+	pair.LocalConn = nil
+	record = pair.accessRecord(reasonShutdown, now)
+	if record.Host != "" || record.UpstreamAddr != "" || record.ConnectTime != 0 {
+		t.Errorf("not connected: %+v", record)
+	}
+}
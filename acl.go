@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/spf13/viper"
+	"github.com/xjdrew/glog"
+)
+
+var errInvalidCIDR = errors.New("invalid cidr")
+
+// cidrNode is a node of binary trie, indexed by bits of ip
+type cidrNode struct {
+	children [2]*cidrNode
+	terminal bool // a prefix ends here
+}
+
+// cidrSet matches ip by prefixes in O(bits of ip)
+type cidrSet struct {
+	v4  cidrNode
+	v6  cidrNode
+	len int
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errInvalidCIDR
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, errInvalidCIDR
+	}
+	return ipnet, nil
+}
+
+func (s *cidrSet) root(ip net.IP) (*cidrNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &s.v4, ip4
+	}
+	return &s.v6, ip.To16()
+}
+
+// Add adds cidr, or a single ip
+func (s *cidrSet) Add(cidr string) error {
+	ipnet, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	node, ip := s.root(ipnet.IP)
+	ones, bits := ipnet.Mask.Size()
+	if len(ip) == net.IPv4len && bits == 8*net.IPv6len {
+		// ipv4-mapped ipv6 prefix, e.g. ::ffff:10.0.0.0/104
+		if ones >= 96 {
+			ones -= 96
+		} else {
+			node, ip = &s.v6, ipnet.IP.To16()
+		}
+	}
+	for i := 0; i < ones && !node.terminal; i++ {
+		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &cidrNode{}
+		}
+		node = node.children[bit]
+	}
+	if !node.terminal {
+		// longer prefixes are covered
+		node.terminal = true
+		node.children = [2]*cidrNode{}
+	}
+	s.len++
+	return nil
+}
+
+// Contains reports whether ip is in any prefix
+func (s *cidrSet) Contains(ip net.IP) bool {
+	node, ip := s.root(ip)
+	for i := 0; node != nil; i++ {
+		if node.terminal {
+			return true
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.children[(ip[i/8]>>(7-uint(i%8)))&1]
+	}
+	return false
+}
+
+// Len returns count of prefixes added
+func (s *cidrSet) Len() int {
+	return s.len
+}
+
+// loadFile adds cidrs from file, one per line, lines start with '#' are comments
+func (s *cidrSet) loadFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := s.Add(line); err != nil {
+			glog.Errorf("invalid cidr: file=%s, cidr=%s", filename, line)
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// listenerACL is allow and deny lists of a listener
+type listenerACL struct {
+	allow *cidrSet // all are allowed if empty
+	deny  *cidrSet
+}
+
+// ACLOption is option of a listener
+type ACLOption struct {
+	Allow     []string
+	Deny      []string
+	AllowFile string `mapstructure:"allow_file"`
+	DenyFile  string `mapstructure:"deny_file"`
+}
+
+func newCIDRSet(cidrs []string, filename string) (*cidrSet, error) {
+	s := &cidrSet{}
+	for _, cidr := range cidrs {
+		if err := s.Add(cidr); err != nil {
+			glog.Errorf("invalid cidr: cidr=%s", cidr)
+			return nil, err
+		}
+	}
+	if filename != "" {
+		if err := s.loadFile(filename); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func newListenerACL(option *ACLOption) (*listenerACL, error) {
+	allow, err := newCIDRSet(option.Allow, option.AllowFile)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := newCIDRSet(option.Deny, option.DenyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &listenerACL{allow: allow, deny: deny}, nil
+}
+
+// loadACL reads acl of all listeners from config
+func loadACL() (map[string]*listenerACL, error) {
+	var options map[string]*ACLOption
+	if err := viper.UnmarshalKey("acl", &options); err != nil {
+		return nil, err
+	}
+	acls := make(map[string]*listenerACL)
+	for name, option := range options {
+		if option == nil {
+			continue
+		}
+		acl, err := newListenerACL(option)
+		if err != nil {
+			return nil, err
+		}
+		glog.Infof("load acl: listener=%s, allow=%d, deny=%d", name, acl.allow.Len(), acl.deny.Len())
+		acls[name] = acl
+	}
+	return acls, nil
+}
+
+var defaultACL atomic.Value // map[string]*listenerACL
+
+func init() {
+	defaultACL.Store(map[string]*listenerACL{})
+}
+
+// checkACL returns reason if client of conn is not allowed
+func checkACL(conn net.Conn) string {
+	acl := defaultACL.Load().(map[string]*listenerACL)[transportOf(conn)]
+	if acl == nil {
+		return ""
+	}
+	ip := net.ParseIP(ipOf(conn.RemoteAddr()))
+	if ip == nil {
+		return ""
+	}
+	if acl.deny.Contains(ip) {
+		return rejectACLDeny
+	}
+	if acl.allow.Len() > 0 && !acl.allow.Contains(ip) {
+		return rejectACLNotAllowed
+	}
+	return ""
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCIDRSet(t *testing.T) {
+	cases := []struct {
+		cidrs []string
+		ip    string
+		want  bool
+	}{
+		{[]string{"10.0.0.0/8"}, "10.1.2.3", true},
+		{[]string{"10.0.0.0/8"}, "11.1.2.3", false},
+		{[]string{"10.1.2.3"}, "10.1.2.3", true},
+		{[]string{"10.1.2.3"}, "10.1.2.4", false},
+		// overlapping prefixes, in either order
+		{[]string{"10.0.0.0/8", "10.1.0.0/16"}, "10.2.0.1", true},
+		{[]string{"10.1.0.0/16", "10.0.0.0/8"}, "10.2.0.1", true},
+		{[]string{"10.1.0.0/16", "10.1.2.0/24"}, "10.1.3.1", true},
+		{[]string{"10.1.2.0/24", "10.1.0.0/16"}, "10.2.0.1", false},
+		// all ipv4, but not ipv6
+		{[]string{"0.0.0.0/0"}, "1.2.3.4", true},
+		{[]string{"0.0.0.0/0"}, "2001:db8::1", false},
+		{[]string{"::/0"}, "2001:db8::1", true},
+		// ipv4-mapped ipv6
+		{[]string{"10.0.0.0/8"}, "::ffff:10.1.2.3", true},
+		{[]string{"::ffff:10.0.0.0/104"}, "10.1.2.3", true},
+		{[]string{"::ffff:10.0.0.0/104"}, "11.1.2.3", false},
+		{[]string{"::ffff:10.1.2.3"}, "10.1.2.3", true},
+		// ipv6
+		{[]string{"2001:db8::/32"}, "2001:db8:1::1", true},
+		{[]string{"2001:db8::/32"}, "2001:db9::1", false},
+		{[]string{"2001:db8::/32", "2001:db8:1::/48"}, "2001:db8:2::1", true},
+		{[]string{"2001:db8::1"}, "2001:db8::1", true},
+		{[]string{"2001:db8::1"}, "2001:db8::2", false},
+		{[]string{"2001:db8::/127"}, "2001:db8::1", true},
+		{[]string{"2001:db8::/127"}, "2001:db8::2", false},
+	}
+	for i, c := range cases {
+		s := &cidrSet{}
+		for _, cidr := range c.cidrs {
+			if err := s.Add(cidr); err != nil {
+				t.Fatalf("case %d: add %s: %v", i, cidr, err)
+			}
+		}
+		if got := s.Contains(net.ParseIP(c.ip)); got != c.want {
+			t.Errorf("case %d: %v contains %s = %v, want %v", i, c.cidrs, c.ip, got, c.want)
+		}
+	}
+
+	s := &cidrSet{}
+	for _, cidr := range []string{"", "10.0.0.0/33", "10.0.0", "2001:db8::/129"} {
+		if err := s.Add(cidr); err == nil {
+			t.Errorf("invalid cidr %q is added", cidr)
+		}
+	}
+	if s.Len() != 0 || s.Contains(net.ParseIP("10.0.0.1")) {
+		t.Errorf("empty set: len=%d", s.Len())
+	}
+}
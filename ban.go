@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ejoy/goscon/scp"
+	"github.com/xjdrew/glog"
+)
+
+// interval to remove stale records
+const banSweepInterval = time.Minute
+
+// BanInfo is a banned ip
+type BanInfo struct {
+	IP       string    `json:"ip"`
+	Failures int       `json:"failures"`
+	BannedAt time.Time `json:"banned_at"`
+	ExpireAt time.Time `json:"expire_at"`
+}
+
+type banRecord struct {
+	failures    []time.Time // in ban.find_time
+	banFailures int         // count of failures caused ban
+	bannedAt    time.Time
+	expireAt    time.Time // zero if not banned
+}
+
+// banTracker bans ip for ban.ban_time after ban.max_failures handshake failures in ban.find_time
+type banTracker struct {
+	mu        sync.Mutex
+	records   map[string]*banRecord
+	lastSweep time.Time
+}
+
+var defaultBanTracker = &banTracker{
+	records: make(map[string]*banRecord),
+}
+
+// isBanFailure reports whether err looks like probing
+func isBanFailure(err error) bool {
+	var serr *scp.Error
+	if !errors.As(err, &serr) {
+		return false
+	}
+	return serr.Code == scp.SCPStatusBadRequest || serr.Code == scp.SCPStatusUnauthorized
+}
+
+func (t *banTracker) sweep(now time.Time, findTime time.Duration) {
+	for ip, r := range t.records {
+		if !r.expireAt.IsZero() && now.After(r.expireAt) {
+			r.expireAt = time.Time{}
+		}
+		if r.expireAt.IsZero() && (len(r.failures) == 0 || now.Sub(r.failures[len(r.failures)-1]) > findTime) {
+			delete(t.records, ip)
+		}
+	}
+	t.lastSweep = now
+}
+
+// IsBanned reports whether ip is banned
+func (t *banTracker) IsBanned(ip string) bool {
+	return t.isBanned(ip, time.Now())
+}
+
+func (t *banTracker) isBanned(ip string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.records[ip]
+	return ok && !r.expireAt.IsZero() && now.Before(r.expireAt)
+}
+
+// OnFailure records a handshake failure of ip, bans it if failures reach limit
+func (t *banTracker) OnFailure(ip string) {
+	t.onFailure(ip, time.Now())
+}
+
+func (t *banTracker) onFailure(ip string, now time.Time) {
+	maxFailures := configItemInt("ban.max_failures")
+	if maxFailures <= 0 {
+		return
+	}
+	findTime := configItemTime("ban.find_time")
+	banTime := configItemTime("ban.ban_time")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now.Sub(t.lastSweep) > banSweepInterval {
+		t.sweep(now, findTime)
+	}
+
+	r, ok := t.records[ip]
+	if !ok {
+		r = &banRecord{}
+		t.records[ip] = r
+	}
+	if !r.expireAt.IsZero() && now.Before(r.expireAt) {
+		return
+	}
+
+	// drop failures out of window
+	i := 0
+	for i < len(r.failures) && now.Sub(r.failures[i]) > findTime {
+		i++
+	}
+	r.failures = append(r.failures[i:], now)
+	if len(r.failures) < maxFailures {
+		return
+	}
+
+	glog.Errorf("ip banned: ip=%s, failures=%d, ban_time=%v", ip, len(r.failures), banTime)
+	r.banFailures = len(r.failures)
+	r.failures = nil
+	r.bannedAt = now
+	r.expireAt = now.Add(banTime)
+	ipBans.Inc()
+}
+
+// List returns banned ips sorted by ip
+func (t *banTracker) List() []*BanInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	bans := []*BanInfo{}
+	for ip, r := range t.records {
+		if r.expireAt.IsZero() || now.After(r.expireAt) {
+			continue
+		}
+		bans = append(bans, &BanInfo{
+			IP:       ip,
+			Failures: r.banFailures,
+			BannedAt: r.bannedAt,
+			ExpireAt: r.expireAt,
+		})
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].IP < bans[j].IP
+	})
+	return bans
+}
+
+// Clear removes ban and failures of ip, or of all ips if ip is empty, returns count of bans removed
+func (t *banTracker) Clear(ip string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	n := 0
+	for k, r := range t.records {
+		if ip != "" && k != ip {
+			continue
+		}
+		if !r.expireAt.IsZero() && now.Before(r.expireAt) {
+			n++
+		}
+		delete(t.records, k)
+	}
+	return n
+}
+
+func listBans(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(defaultBanTracker.List())
+}
+
+// clearBans removes ban of ip, or all bans if all=true
+func clearBans(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ip := r.FormValue("ip")
+	if ip == "" && r.FormValue("all") != "true" {
+		io.WriteString(w, "failed: "+errInvalidParameter.Error())
+		return
+	}
+	n := defaultBanTracker.Clear(ip)
+	glog.Infof("ban clear: ip=%s, cleared=%d, caller=%s", ip, n, callerOf(r))
+	io.WriteString(w, fmt.Sprintf("succeed: cleared=%d", n))
+}
+
+func registerBanHandlers() {
+	http.HandleFunc("/bans", listBans)
+	http.HandleFunc("/bans/clear", clearBans)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBanTracker(t *testing.T) {
+	defer setConfigItems(map[string]interface{}{
+		"ban.max_failures": 3,
+		"ban.find_time":    10,
+		"ban.ban_time":     60,
+	})()
+
+	bt := &banTracker{records: make(map[string]*banRecord)}
+	ip := "10.0.0.1"
+	now := time.Now()
+
+	// failures out of find_time don't count
+	bt.onFailure(ip, now)
+	bt.onFailure(ip, now.Add(time.Second))
+	now = now.Add(12 * time.Second)
+	bt.onFailure(ip, now)
+	if bt.isBanned(ip, now) {
+		t.Fatal("banned by failures out of window")
+	}
+
+	// banned when failures in window reach max_failures
+	bt.onFailure(ip, now.Add(time.Second))
+	if bt.isBanned(ip, now.Add(time.Second)) {
+		t.Fatal("banned before max_failures")
+	}
+	now = now.Add(2 * time.Second)
+	bt.onFailure(ip, now)
+	if !bt.isBanned(ip, now) {
+		t.Fatal("not banned after max_failures")
+	}
+	if bt.isBanned("10.0.0.2", now) {
+		t.Error("other ip is banned")
+	}
+	if bans := bt.List(); len(bans) != 1 || bans[0].IP != ip || bans[0].Failures != 3 {
+		t.Errorf("bans: %+v", bans)
+	}
+
+	// ban expires after ban_time, failures start over
+	now = now.Add(61 * time.Second)
+	if bt.isBanned(ip, now) {
+		t.Fatal("ban not expired")
+	}
+	bt.onFailure(ip, now)
+	bt.onFailure(ip, now)
+	if bt.isBanned(ip, now) {
+		t.Fatal("banned again before max_failures")
+	}
+
+	// expired records are swept
+	bt.sweep(now.Add(time.Hour), 10*time.Second)
+	if len(bt.records) != 0 {
+		t.Errorf("records not swept: %d", len(bt.records))
+	}
+
+	bt.onFailure(ip, now)
+	bt.onFailure(ip, now)
+	bt.onFailure(ip, now)
+	if n := bt.Clear(""); n != 1 || len(bt.records) != 0 {
+		t.Errorf("clear: n=%d, records=%d", n, len(bt.records))
+	}
+}
+
+func TestBanDisabled(t *testing.T) {
+	defer setConfigItems(map[string]interface{}{"ban.max_failures": 0})()
+
+	bt := &banTracker{records: make(map[string]*banRecord)}
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		bt.onFailure("10.0.0.1", now)
+	}
+	if bt.isBanned("10.0.0.1", now) {
+		t.Error("banned while disabled")
+	}
+}
+
+func TestBanPathsRequireAdmin(t *testing.T) {
+	for _, path := range []string{"/bans", "/bans/clear"} {
+		if role := requiredRole(path); role != roleAdmin {
+			t.Errorf("%s: role=%s", path, role)
+		}
+	}
+}
@@ -17,6 +17,9 @@ import (
 var (
 	configMu    sync.Mutex
 	configCache map[string]interface{}
+
+	// serialize reloading config and applying hosts file
+	reloadMu sync.Mutex
 )
 
 // ErrInvalidConfig .
@@ -29,6 +32,27 @@ func init() {
 	viper.SetDefault("tcp", "0.0.0.0:1248") // listen tcp: yes
 	viper.SetDefault("kcp", "")             // listen kcp: no
 
+	viper.SetDefault("drain_timeout", 300) // drain_timeout: 300s, 收到 SIGTERM 后停止接受新连接，等待已有连接结束的最长时间
+
+	viper.SetDefault("limit.max_sessions", 0)        // limit max_sessions: 0, 全局最大会话数，0 表示不限制，超出时新建连接返回 429
+	viper.SetDefault("limit.max_sessions_per_ip", 0) // limit max_sessions_per_ip: 0, 每个 ip（或网段）的最大会话数，0 表示不限制
+	viper.SetDefault("limit.ipv4_prefix", 32)        // limit ipv4_prefix: 32, 按该长度的前缀合并 ipv4 地址计数
+	viper.SetDefault("limit.ipv6_prefix", 64)        // limit ipv6_prefix: 64, 按该长度的前缀合并 ipv6 地址计数
+	viper.SetDefault("limit.handshake_rate", 0)      // limit handshake_rate: 0, 每个 ip（或网段）每秒允许的握手次数，0 表示不限制，超出时直接关闭连接
+	viper.SetDefault("limit.handshake_burst", 10)    // limit handshake_burst: 10, 握手次数的突发上限
+
+	viper.SetDefault("ban.max_failures", 0) // ban max_failures: 0, 同一 ip 在 find_time 内握手失败（400、401）达到该次数后封禁，0 表示不封禁
+	viper.SetDefault("ban.find_time", 60)   // ban find_time: 60s, 统计握手失败次数的时间窗口
+	viper.SetDefault("ban.ban_time", 600)   // ban ban_time: 600s, 封禁时间，封禁期间的连接在 accept 后直接关闭
+
+	viper.SetDefault("overload.max_goroutines", 0) // overload max_goroutines: 0, goroutine 数超过该值时拒绝新建连接（返回 503），重连不受影响，0 表示不检查
+	viper.SetDefault("overload.max_heap", 0)       // overload max_heap: 0MB, 堆内存（HeapInuse）超过该值时拒绝新建连接，0 表示不检查
+	viper.SetDefault("overload.max_handshakes", 0) // overload max_handshakes: 0, 正在握手的连接数超过该值时拒绝新建连接，0 表示不检查
+	viper.SetDefault("overload.check_interval", 1) // overload check_interval: 1s, 采样 goroutine 数及内存的最小间隔
+	viper.SetDefault("overload.retry_after", 5)    // overload retry_after: 5s, 拒绝时建议客户端重试的等待时间，实际值加上 [0, retry_after) 的随机量
+
+	viper.SetDefault("metric_max_targets", 1000) // metric_max_targets: 1000, 指标中 target 标签的最大取值数量，targetServer 由客户端指定，超出后记为 _other
+
 	viper.SetDefault("scp.handshake_timeout", 30) // scp handshake_timeout: 30s, scp握手超时时间
 	viper.SetDefault("scp.reuse_time", 30)        // scp reuse_time: 30s, 客户端断开后，等待重用的时间
 	viper.SetDefault("scp.reuse_buffer", 65536)   // scp reuse_buffer: 64kb, 等待重连期间，缓存发送给客户端的数据；合理值为reuse_time*流量速度
@@ -55,13 +79,26 @@ func init() {
 	viper.SetDefault("kcp_option.opt_stream", true)      // kcp opt_stream: true, 是否启用kcp流模式; 流模式下，会合并udp包发送
 	viper.SetDefault("kcp_option.opt_writedelay", false) // kcp opt_writedelay: false, 延迟到下次interval发送数据
 
-	viper.SetDefault("upstream_option.net", "tcp") // upstream net: tcp,  默认使用 tcp 连接后端服务器，可以指定使用 scp 协议保证连接自动重连。
+	viper.SetDefault("upstream_option.net", "tcp")      // upstream net: tcp,  默认使用 tcp 连接后端服务器，可以指定使用 scp 协议保证连接自动重连。
+	viper.SetDefault("upstream_option.max_attempts", 3) // upstream max_attempts: 3, 新建连接时最多尝试的后端数量，优先尝试同名的其他后端，再尝试所有后端
+	viper.SetDefault("upstream_option.dial_timeout", 5) // upstream dial_timeout: 5s, 单次连接后端的超时时间
+
+	viper.SetDefault("manager_option.tls_cert", "") // manager tls_cert: 证书文件，与 tls_key 同时设置时 manager 使用 https
+	viper.SetDefault("manager_option.tls_key", "")  // manager tls_key: 私钥文件
+
+	viper.SetDefault("access_log.file", "")               // access_log file: 为空表示不记录；每个会话结束时写一行 json
+	viper.SetDefault("access_log.max_size", 100)          // access_log max_size: 100MB, 文件超过该大小时切分
+	viper.SetDefault("access_log.rotate_interval", 86400) // access_log rotate_interval: 86400s, 定时切分，0 表示不按时间切分
+	viper.SetDefault("access_log.max_backups", 7)         // access_log max_backups: 7, 保留的切分文件数量，0 表示全部保留
+
+	viper.SetDefault("hosts_file", "") // hosts_file: 为空表示使用配置中的 hosts；否则从该 json/yaml 文件读取后端列表，文件变化时自动生效
 
 	configCache = make(map[string]interface{})
 }
 
 func marshalConfigFile() (s string) {
 	c := viper.AllSettings()
+	redactConfig(c)
 	b, err := yaml.Marshal(c)
 	if err != nil {
 		glog.Errorf("marshal failed: err=%s", err.Error())
@@ -76,6 +113,9 @@ func marshalConfigFile() (s string) {
 }
 
 func reloadConfig() (err error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
 	glog.Info("load config")
 
 	// try to load config from disk
@@ -101,6 +141,38 @@ func reloadConfig() (err error) {
 	}
 	configMu.Unlock()
 
+	var managerOpt ManagerOption
+	if err = viper.UnmarshalKey("manager_option", &managerOpt); err != nil {
+		glog.Errorf("unmarshal manager option failed: %s", err.Error())
+		return err
+	}
+	if err = managerOpt.validate(); err != nil {
+		glog.Errorf("invalid manager option: %s", err.Error())
+		return err
+	}
+
+	acls, err := loadACL()
+	if err != nil {
+		glog.Errorf("load acl failed: %s", err.Error())
+		return err
+	}
+
+	var throttleOpt ThrottleOption
+	if err = viper.UnmarshalKey("throttle", &throttleOpt); err != nil {
+		glog.Errorf("unmarshal throttle option failed: %s", err.Error())
+		return err
+	}
+
+	var maintenanceOpt MaintenanceOption
+	if err = viper.UnmarshalKey("maintenance", &maintenanceOpt); err != nil {
+		glog.Errorf("unmarshal maintenance option failed: %s", err.Error())
+		return err
+	}
+	if err = maintenanceOpt.validate(); err != nil {
+		glog.Errorf("invalid maintenance option: %s", err.Error())
+		return err
+	}
+
 	var option upstream.Option
 	if err = viper.UnmarshalKey("upstream_option", &option); err != nil {
 		glog.Errorf("unmarshal option failed: %s", err.Error())
@@ -116,7 +188,14 @@ func reloadConfig() (err error) {
 
 	// update upstream
 	var hosts []upstream.Host
-	if err = viper.UnmarshalKey("hosts", &hosts); err != nil {
+	var hostsVersion hostsFileVersion
+	hostsFile := viper.GetString("hosts_file")
+	if hostsFile != "" {
+		if hosts, hostsVersion, err = defaultHostsFile.Load(hostsFile); err != nil {
+			glog.Errorf("read hosts file failed: file=%s, err=%s", hostsFile, err.Error())
+			return err
+		}
+	} else if err = viper.UnmarshalKey("hosts", &hosts); err != nil {
 		glog.Errorf("unmarshal hosts failed: %s", err.Error())
 		return err
 	}
@@ -128,8 +207,32 @@ func reloadConfig() (err error) {
 
 	// Truly update all the config state, should not error below.
 
+	// set manager option
+	managerOption.Store(&managerOpt)
+
+	// set acl of listeners
+	defaultACL.Store(acls)
+
+	// set throttle of sessions
+	throttleOption.Store(&throttleOpt)
+
+	// set maintenance, discard changes by manager
+	setMaintenance(&maintenanceOpt)
+
+	// set access log, retry to open file when writing if failed
+	accessLogOpt := AccessLogOption{
+		File:           viper.GetString("access_log.file"),
+		MaxSize:        viper.GetInt("access_log.max_size"),
+		RotateInterval: viper.GetInt("access_log.rotate_interval"),
+		MaxBackups:     viper.GetInt("access_log.max_backups"),
+	}
+	if err := accessLog.SetOption(&accessLogOpt); err != nil {
+		glog.Errorf("open access log failed: file=%s, err=%s", accessLogOpt.File, err.Error())
+	}
+
 	// set upstream option
 	upstream.SetOption(&option)
+	defaultHostsFile.Applied(&option, hostsFile, hostsVersion)
 
 	// update scp
 	reuseBuffer := viper.GetInt("scp.reuse_buffer")
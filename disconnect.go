@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// side of conn
+const (
+	sideClient   = "client"
+	sideUpstream = "upstream"
+)
+
+// reasons of disconnection, reasons of conn are prefixed by side, e.g. client_eof, upstream_error
+const (
+	reasonEOF          = "eof"
+	reasonTimeout      = "timeout"
+	reasonReset        = "reset"
+	reasonError        = "error"
+	reasonReuseTimeout = "reuse_timeout" // conn is not reused in time
+
+	reasonConnectFailed = "upstream_connect_failed"
+	reasonKick          = "kick"
+	reasonShutdown      = "shutdown"
+)
+
+// classifyErr tells reason of err on conn of side
+func classifyErr(side string, err error) string {
+	var ne net.Error
+	switch {
+	case err == io.EOF:
+		return side + "_" + reasonEOF
+	case errors.As(err, &ne) && ne.Timeout():
+		return side + "_" + reasonTimeout
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE):
+		return side + "_" + reasonReset
+	default:
+		return side + "_" + reasonError
+	}
+}
+
+// closeReasonOf tells why the pair ends by the first finished pump
+func (p *connPair) closeReasonOf(first *pumpResult) string {
+	// closed by server
+	if reason := p.getCloseReason(); reason != "" {
+		return reason
+	}
+
+	// c2s reads from client and writes to upstream, s2c is the opposite
+	clientErr, upstreamErr := first.readErr, first.writeErr
+	if first.tag == "s2c" {
+		clientErr, upstreamErr = first.writeErr, first.readErr
+	}
+	if upstreamErr != nil {
+		if local, ok := p.LocalConn.(*LocalSCPConn); ok {
+			if reason := local.CloseReason(); reason != "" {
+				return reason
+			}
+		}
+		return classifyErr(sideUpstream, upstreamErr)
+	}
+	if reason := p.RemoteConn.CloseReason(); reason != "" {
+		return reason
+	}
+	return classifyErr(sideClient, clientErr)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ejoy/goscon/upstream"
+	"github.com/fsnotify/fsnotify"
+	"github.com/xjdrew/glog"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// wait for the file to be written completely
+const hostsFileDelay = 200 * time.Millisecond
+
+// hostsFileContent is the format of hosts file, a bare list of hosts is also accepted
+type hostsFileContent struct {
+	Revision string
+	Hosts    []upstream.Host
+}
+
+// HostsFileStatus reports status of hosts file
+type HostsFileStatus struct {
+	File      string    `json:"file"`
+	Revision  string    `json:"revision"` // revision in file, digest if absent
+	Digest    string    `json:"digest"`   // digest of content, file is applied when it changes
+	AppliedAt time.Time `json:"applied_at"`
+	Error     string    `json:"error,omitempty"`
+	ErrorAt   time.Time `json:"error_at"`
+}
+
+// hostsFile watches a file of upstream hosts, and applies it when changed
+type hostsFile struct {
+	mu      sync.Mutex
+	option  *upstream.Option
+	watcher *fsnotify.Watcher
+	timer   *time.Timer
+	status  HostsFileStatus
+}
+
+var defaultHostsFile hostsFile
+
+// hostsFileVersion identifies content of hosts file
+type hostsFileVersion struct {
+	revision string
+	digest   string
+}
+
+func readHostsFile(path string) (hosts []upstream.Host, version hostsFileVersion, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	var content hostsFileContent
+	if strings.HasSuffix(path, ".json") {
+		if err = json.Unmarshal(data, &content); err != nil {
+			err = json.Unmarshal(data, &content.Hosts)
+		}
+	} else {
+		if err = yaml.Unmarshal(data, &content); err != nil {
+			err = yaml.Unmarshal(data, &content.Hosts)
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	// revision in file may be kept across edits, so changes are detected by digest
+	sum := sha1.Sum(data)
+	version.digest = hex.EncodeToString(sum[:8])
+	version.revision = content.Revision
+	if version.revision == "" {
+		version.revision = version.digest
+	}
+	return content.Hosts, version, nil
+}
+
+// Load reads hosts from file for reloadConfig
+func (f *hostsFile) Load(path string) ([]upstream.Host, hostsFileVersion, error) {
+	hosts, version, err := readHostsFile(path)
+	if err != nil {
+		f.setError(path, err)
+	}
+	return hosts, version, err
+}
+
+// Applied is called after hosts of file is applied by reloadConfig, path is empty if hosts file is not used
+func (f *hostsFile) Applied(option *upstream.Option, path string, version hostsFileVersion) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.option = option
+	if path == "" {
+		f.stopWatch()
+		f.status = HostsFileStatus{}
+		return
+	}
+
+	f.status = HostsFileStatus{
+		File:      path,
+		Revision:  version.revision,
+		Digest:    version.digest,
+		AppliedAt: time.Now(),
+	}
+	if err := f.startWatch(path); err != nil {
+		glog.Errorf("watch hosts file failed: file=%s, err=%s", path, err.Error())
+		f.status.Error = err.Error()
+		f.status.ErrorAt = time.Now()
+	}
+}
+
+// Status .
+func (f *hostsFile) Status() HostsFileStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status
+}
+
+func (f *hostsFile) setError(path string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status.File = path
+	f.status.Error = err.Error()
+	f.status.ErrorAt = time.Now()
+}
+
+func (f *hostsFile) stopWatch() {
+	if f.watcher != nil {
+		f.watcher.Close()
+		f.watcher = nil
+	}
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+}
+
+// startWatch watches the directory of path, as the file may be replaced by rename
+func (f *hostsFile) startWatch(path string) error {
+	f.stopWatch()
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err = watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	f.watcher = watcher
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(path) {
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				f.schedule(watcher, path)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				glog.Errorf("watch hosts file failed: file=%s, err=%s", path, err.Error())
+			}
+		}
+	}()
+	return nil
+}
+
+func (f *hostsFile) schedule(watcher *fsnotify.Watcher, path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.watcher != watcher {
+		return
+	}
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+	f.timer = time.AfterFunc(hostsFileDelay, func() {
+		f.apply(watcher, path)
+	})
+}
+
+// apply applies hosts file through upstream.UpdateHosts, keeps the previous hosts if failed
+func (f *hostsFile) apply(watcher *fsnotify.Watcher, path string) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.watcher != watcher {
+		return
+	}
+
+	hosts, version, err := readHostsFile(path)
+	if err == nil && version.digest == f.status.Digest {
+		return
+	}
+	if err == nil {
+		err = upstream.UpdateHosts(f.option, hosts)
+	}
+	if err != nil {
+		glog.Errorf("apply hosts file failed: file=%s, err=%s", path, err.Error())
+		f.status.Error = err.Error()
+		f.status.ErrorAt = time.Now()
+		return
+	}
+
+	glog.Infof("apply hosts file: file=%s, revision=%s, digest=%s, hosts=%d", path, version.revision, version.digest, len(hosts))
+	f.status.Revision = version.revision
+	f.status.Digest = version.digest
+	f.status.AppliedAt = time.Now()
+	f.status.Error = ""
+	f.status.ErrorAt = time.Time{}
+}
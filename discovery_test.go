@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ejoy/goscon/upstream"
+)
+
+func TestReadHostsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goscon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		name     string
+		data     string
+		hosts    int
+		revision string
+		ok       bool
+	}{
+		{"hosts.yaml", "revision: r1\nhosts:\n- name: s1\n  addr: 127.0.0.1:1\n", 1, "r1", true},
+		{"hosts.yml", "- name: s1\n  addr: 127.0.0.1:1\n- name: s2\n  addr: 127.0.0.1:2\n", 2, "", true},
+		{"hosts.json", `{"revision": "r2", "hosts": [{"name": "s1", "addr": "127.0.0.1:1"}]}`, 1, "r2", true},
+		{"list.json", `[{"name": "s1", "addr": "127.0.0.1:1"}]`, 1, "", true},
+		{"bad.json", `{"hosts": [`, 0, "", false},
+		{"bad.yaml", "hosts: [\n", 0, "", false},
+	}
+	for _, c := range cases {
+		path := filepath.Join(dir, c.name)
+		if err := ioutil.WriteFile(path, []byte(c.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		hosts, version, err := readHostsFile(path)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: err=%v", c.name, err)
+			continue
+		}
+		if !c.ok {
+			continue
+		}
+		if len(hosts) != c.hosts || version.digest == "" {
+			t.Errorf("%s: hosts=%v, version=%+v", c.name, hosts, version)
+		}
+		// digest is the revision if file has none
+		if revision := c.revision; revision == "" {
+			if version.revision != version.digest {
+				t.Errorf("%s: revision=%s, digest=%s", c.name, version.revision, version.digest)
+			}
+		} else if version.revision != revision {
+			t.Errorf("%s: revision=%s, want %s", c.name, version.revision, revision)
+		}
+	}
+}
+
+func TestHostsFileApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goscon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts.yaml")
+
+	f := &hostsFile{option: &upstream.Option{ResolveInterval: -1}}
+	steps := []struct {
+		data     string
+		hosts    int    // hosts in upstream after applied
+		revision string // revision in status
+		applied  bool   // whether the file is applied
+		failed   bool   // whether error is reported
+	}{
+		{"revision: r1\nhosts:\n- name: s1\n  addr: 127.0.0.1:1\n", 1, "r1", true, false},
+		// same revision, content changed
+		{"revision: r1\nhosts:\n- name: s1\n  addr: 127.0.0.1:1\n- name: s2\n  addr: 127.0.0.1:2\n", 2, "r1", true, false},
+		// same content
+		{"revision: r1\nhosts:\n- name: s1\n  addr: 127.0.0.1:1\n- name: s2\n  addr: 127.0.0.1:2\n", 2, "r1", false, false},
+		// invalid file keeps last good hosts
+		{"revision: r2\nhosts: [\n", 2, "r1", false, true},
+		{"revision: r2\nhosts: []\n", 2, "r1", false, true},
+		// recovered, without revision
+		{"hosts:\n- name: s3\n  addr: 127.0.0.1:3\n", 1, "", true, false},
+	}
+	for i, step := range steps {
+		if err := ioutil.WriteFile(path, []byte(step.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		appliedAt := f.status.AppliedAt
+		f.apply(nil, path)
+
+		status := f.Status()
+		if hosts := upstream.Hosts(); len(hosts) != step.hosts {
+			t.Errorf("step %d: hosts=%v", i, hosts)
+		}
+		if step.revision != "" && status.Revision != step.revision {
+			t.Errorf("step %d: revision=%s, want %s", i, status.Revision, step.revision)
+		}
+		if step.revision == "" && status.Revision != status.Digest {
+			t.Errorf("step %d: revision=%s, digest=%s", i, status.Revision, status.Digest)
+		}
+		if applied := status.AppliedAt != appliedAt; applied != step.applied {
+			t.Errorf("step %d: applied=%v", i, applied)
+		}
+		if failed := status.Error != ""; failed != step.failed {
+			t.Errorf("step %d: error=%s", i, status.Error)
+		}
+	}
+}
@@ -239,6 +239,7 @@ var optRunRounds uint
 var optVerbose bool
 var network string
 var optTargetServer string
+var optHashKey string
 var optSproto bool
 var fecData, fecParity int
 
@@ -262,6 +263,7 @@ func main() {
 	flag.BoolVar(&optEchoClient, "startEchoClient", false, "start echo client")
 	flag.BoolVar(&optVerbose, "verbose", false, "verbose")
 	flag.StringVar(&optTargetServer, "targetServer", "", "prefered targetserver")
+	flag.StringVar(&optHashKey, "hashKey", "", "hash key for consistent hashing of upstream hosts")
 	kcp := flag.NewFlagSet("kcp", flag.ExitOnError)
 	kcp.IntVar(&fecData, "fec_data", 1, "FEC: number of shards to split the data into")
 	kcp.IntVar(&fecParity, "fec_parity", 0, "FEC: number of parity shards")
@@ -299,7 +301,7 @@ func main() {
 			glog.Errorf("start echo client: %s", err.Error())
 			return
 		}
-		scon, _ := scp.Client(conn, &scp.Config{TargetServer: optTargetServer})
+		scon, _ := scp.Client(conn, &scp.Config{TargetServer: optTargetServer, HashKey: optHashKey})
 		go io.Copy(os.Stdout, scon)
 		io.Copy(scon, os.Stdin)
 		return
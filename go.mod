@@ -3,16 +3,19 @@ module github.com/ejoy/goscon
 go 1.13
 
 require (
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/klauspost/cpuid v1.2.1 // indirect
 	github.com/klauspost/reedsolomon v1.9.3 // indirect
 	github.com/libp2p/go-reuseport v0.0.1
 	github.com/prometheus/client_golang v1.0.0
+	github.com/prometheus/client_model v0.0.0-20190129233127-fd36f4220a90
 	github.com/spf13/viper v1.4.0
 	github.com/templexxx/cpufeat v0.0.0-20180724012125-cef66df7f161 // indirect
 	github.com/templexxx/xor v0.0.0-20181023030647-4e92f724b73b // indirect
 	github.com/tjfoc/gmsm v1.0.1 // indirect
 	github.com/xjdrew/glog v0.0.0-20191120014404-9a6d6b19a763
 	github.com/xjdrew/gosproto v0.1.0
+	// pinned: kcpstats.go reads unexported fields of UDPSession and KCP, run TestKCPSessionStats before upgrading
 	github.com/xtaci/kcp-go v5.4.20+incompatible
 	github.com/xtaci/lossyconn v0.0.0-20190602105132-8df528c0c9ae // indirect
 	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550 // indirect
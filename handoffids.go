@@ -0,0 +1,163 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ejoy/goscon/scp"
+)
+
+// Ids of sessions handed over by upgrade. Old process sends ids in use with listeners, then takes ids
+// of sessions still in handshake from a block after them, which is reserved by new process too.
+// So new process never gives an id to a new session before the old session of it is handed over.
+const (
+	handoffIDBlock   = 4096             // ids reserved for sessions in handshake when old process sends ids
+	handoffReuseWait = 20 * time.Second // reuse of a session being handed over waits for it, longer than handoffPairTimeout
+)
+
+type handoffIDs struct {
+	mu sync.Mutex
+
+	// old process, ids of new sessions since ids are sent
+	late      *scp.IDAllocator
+	lateStart int
+
+	// new process, ids reserved for sessions being handed over
+	pending map[int]bool
+	changed chan struct{} // closed when pending changes
+}
+
+// AcquireID implments scp.SCPServer interface
+func (ss *SCPServer) AcquireID() int {
+	ss.handoff.mu.Lock()
+	defer ss.handoff.mu.Unlock()
+	if ss.handoff.late != nil {
+		return ss.handoff.late.AcquireID()
+	}
+	return ss.idAllocator.AcquireID()
+}
+
+// ReleaseID implments scp.SCPServer interface
+func (ss *SCPServer) ReleaseID(id int) {
+	ss.handoff.mu.Lock()
+	defer ss.handoff.mu.Unlock()
+	if ss.handoff.late != nil && id >= ss.handoff.lateStart {
+		ss.handoff.late.ReleaseID(id)
+		return
+	}
+	ss.idAllocator.ReleaseID(id)
+}
+
+// isHandingOver reports whether ids are sent to new process, new sessions are refused since then
+func (ss *SCPServer) isHandingOver() bool {
+	ss.handoff.mu.Lock()
+	defer ss.handoff.mu.Unlock()
+	return ss.handoff.late != nil
+}
+
+// freezeIDs returns ids in use and start of the block for sessions in handshake
+func (ss *SCPServer) freezeIDs() ([]int, int) {
+	ss.handoff.mu.Lock()
+	defer ss.handoff.mu.Unlock()
+	ids, next := ss.idAllocator.Acquired()
+	ss.handoff.late = scp.NewIDAllocator(next)
+	ss.handoff.lateStart = next
+	return ids, next
+}
+
+// unfreezeIDs takes back ids of the block if upgrade fails
+func (ss *SCPServer) unfreezeIDs() {
+	ss.handoff.mu.Lock()
+	defer ss.handoff.mu.Unlock()
+	if ss.handoff.late == nil {
+		return
+	}
+	ids, _ := ss.handoff.late.Acquired()
+	for _, id := range ids {
+		ss.idAllocator.ReserveID(id)
+	}
+	ss.handoff.late = nil
+}
+
+// reserveHandoffIDs reserves ids of sessions in old process and the block after them, before serving
+func (ss *SCPServer) reserveHandoffIDs(ids []int, lateStart int) {
+	ss.handoff.mu.Lock()
+	defer ss.handoff.mu.Unlock()
+	ss.handoff.pending = make(map[int]bool, len(ids)+handoffIDBlock)
+	ss.handoff.changed = make(chan struct{})
+	reserve := func(id int) {
+		if ss.idAllocator.ReserveID(id) {
+			ss.handoff.pending[id] = true
+		}
+	}
+	for _, id := range ids {
+		reserve(id)
+	}
+	for id := lateStart; id < lateStart+handoffIDBlock; id++ {
+		reserve(id)
+	}
+}
+
+// notifyHandoffIDs wakes reuse waiting for pending ids, must be called with lock held
+func (ss *SCPServer) notifyHandoffIDs() {
+	close(ss.handoff.changed)
+	ss.handoff.changed = make(chan struct{})
+}
+
+// acquireHandoffID reserves id for a session restored from old process
+func (ss *SCPServer) acquireHandoffID(id int) bool {
+	ss.handoff.mu.Lock()
+	pending := ss.handoff.pending[id]
+	ss.handoff.mu.Unlock()
+	return pending || ss.idAllocator.ReserveID(id)
+}
+
+// endHandoffID is called after session of id is restored or failed,
+// id is owned by the pair if restored, otherwise released
+func (ss *SCPServer) endHandoffID(id int, restored bool) {
+	ss.handoff.mu.Lock()
+	defer ss.handoff.mu.Unlock()
+	if ss.handoff.pending[id] {
+		delete(ss.handoff.pending, id)
+		ss.notifyHandoffIDs()
+	}
+	if !restored {
+		ss.idAllocator.ReleaseID(id)
+	}
+}
+
+// releaseHandoffIDs releases ids not handed over when handoff ends
+func (ss *SCPServer) releaseHandoffIDs() {
+	ss.handoff.mu.Lock()
+	defer ss.handoff.mu.Unlock()
+	if ss.handoff.pending == nil {
+		return
+	}
+	for id := range ss.handoff.pending {
+		ss.idAllocator.ReleaseID(id)
+	}
+	ss.handoff.pending = nil
+	ss.notifyHandoffIDs()
+}
+
+// waitHandoffID waits until session of id is handed over, reports whether id was pending
+func (ss *SCPServer) waitHandoffID(id int) bool {
+	var timer *time.Timer
+	for {
+		ss.handoff.mu.Lock()
+		pending, changed := ss.handoff.pending[id], ss.handoff.changed
+		ss.handoff.mu.Unlock()
+		if !pending {
+			return timer != nil
+		}
+		if timer == nil {
+			timer = time.NewTimer(handoffReuseWait)
+			defer timer.Stop()
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return true
+		}
+	}
+}
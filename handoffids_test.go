@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ejoy/goscon/scp"
+)
+
+func TestHandoffIDsOld(t *testing.T) {
+	ss := &SCPServer{idAllocator: scp.NewIDAllocator(1)}
+	for i := 0; i < 4; i++ {
+		ss.AcquireID()
+	}
+	ss.ReleaseID(2)
+
+	ids, late := ss.freezeIDs()
+	if len(ids) != 3 || late != 5 || !ss.isHandingOver() {
+		t.Fatalf("freeze: ids=%v, late=%d", ids, late)
+	}
+	// sessions in handshake take ids from the block, not the free id 2
+	if id := ss.AcquireID(); id != late {
+		t.Fatalf("id after freeze: %d", id)
+	}
+	ss.AcquireID()
+	ss.ReleaseID(late + 1)
+
+	// upgrade fails, ids of the block are taken back
+	ss.unfreezeIDs()
+	if ss.isHandingOver() {
+		t.Fatal("handing over after unfreeze")
+	}
+	ids, next := ss.idAllocator.Acquired()
+	if len(ids) != 4 || ids[3] != late || next != late+1 {
+		t.Errorf("after unfreeze: ids=%v, next=%d", ids, next)
+	}
+	ss.ReleaseID(late)
+}
+
+func TestHandoffIDsNew(t *testing.T) {
+	ss := &SCPServer{idAllocator: scp.NewIDAllocator(1), connPairs: make(map[int]*connPair)}
+	ss.reserveHandoffIDs([]int{1, 3}, 5)
+
+	// new sessions never take ids of old process
+	for i := 0; i < 2; i++ {
+		if id := ss.AcquireID(); id != 2 && id != 4 && id < 5+handoffIDBlock {
+			t.Fatalf("new session takes id %d", id)
+		}
+	}
+
+	// reuse of a pending id waits for it
+	done := make(chan bool)
+	go func() {
+		done <- ss.waitHandoffID(3)
+	}()
+	select {
+	case <-done:
+		t.Fatal("reuse of pending id doesn't wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if !ss.acquireHandoffID(3) {
+		t.Fatal("pending id is not acquired")
+	}
+	ss.endHandoffID(3, true)
+	if !<-done {
+		t.Error("wait of pending id returns false")
+	}
+	if ss.waitHandoffID(5 + handoffIDBlock) {
+		t.Error("id not pending is waited")
+	}
+
+	// ids not handed over are released when handoff ends
+	ss.endHandoffID(1, false)
+	ss.releaseHandoffIDs()
+	ids, _ := ss.idAllocator.Acquired()
+	if len(ids) != 3 || ids[0] != 2 || ids[1] != 3 || ids[2] != 4 {
+		t.Errorf("after handoff: ids=%v", ids)
+	}
+}
@@ -57,6 +57,8 @@ func (pconn kcpPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 // KCPListener .
 type KCPListener struct {
 	*kcp.Listener
+	conn  net.PacketConn // udp fd
+	laddr string         // address in config
 }
 
 // Accept .
@@ -92,7 +94,14 @@ func (l *KCPListener) Accept() (net.Conn, error) {
 
 // NewKCPListener creates a new KCPListener
 func NewKCPListener(laddr string) (*KCPListener, error) {
-	conn, err := reuseport.ListenPacket("udp", laddr)
+	var conn net.PacketConn
+	var err error
+	if f := inheritedFile("kcp", laddr); f != nil {
+		conn, err = net.FilePacketConn(f)
+		f.Close()
+	} else {
+		conn, err = reuseport.ListenPacket("udp", laddr)
+	}
 	if err != nil {
 		glog.Errorf("new kcp listener failed: %s", err.Error())
 		return nil, err
@@ -120,5 +129,5 @@ func NewKCPListener(laddr string) (*KCPListener, error) {
 
 	// ?
 	// ln.SetDSCP(46)
-	return &KCPListener{ln}, nil
+	return &KCPListener{ln, conn, laddr}, nil
 }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"unsafe"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/xtaci/kcp-go"
+)
+
+// KCPStats is state of a kcp session
+type KCPStats struct {
+	SRTT     int64   `json:"srtt"`   // ms
+	RTTVar   int64   `json:"rttvar"` // ms
+	RTO      int64   `json:"rto"`    // ms
+	SndWnd   int64   `json:"snd_wnd"`
+	RcvWnd   int64   `json:"rcv_wnd"`
+	RmtWnd   int64   `json:"rmt_wnd"`
+	Cwnd     int64   `json:"cwnd"`
+	SndBuf   int     `json:"snd_buf"`   // segments sent but not acked
+	SndQueue int     `json:"snd_queue"` // segments waiting for window
+	RcvBuf   int     `json:"rcv_buf"`   // segments received out of order
+	WndUsage float64 `json:"wnd_usage"` // snd_buf / effective send window
+	Retrans  int     `json:"retrans"`   // segments in snd_buf retransmitted at least once
+}
+
+func kcpSessionOf(conn net.Conn) *kcp.UDPSession {
+	if c, ok := conn.(*kcpConn); ok {
+		return c.UDPSession
+	}
+	return nil
+}
+
+func intField(v reflect.Value, name string) int64 {
+	f := v.FieldByName(name)
+	switch f.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return f.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(f.Uint())
+	}
+	return 0
+}
+
+// kcpStatsErr is set if kcp-go doesn't have the unexported fields read by kcpSessionStats,
+// e.g. after upgrade, then stats of kcp sessions are disabled
+var kcpStatsErr = checkKCPStatsLayout()
+
+func isIntKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// checkKCPStatsLayout validates fields of kcp-go read by kcpSessionStats
+func checkKCPStatsLayout() error {
+	sess := reflect.TypeOf(kcp.UDPSession{})
+	if f, ok := sess.FieldByName("mu"); !ok || f.Type != reflect.TypeOf(sync.Mutex{}) {
+		return fmt.Errorf("UDPSession.mu isn't sync.Mutex")
+	}
+	f, ok := sess.FieldByName("kcp")
+	if !ok || f.Type != reflect.TypeOf(&kcp.KCP{}) {
+		return fmt.Errorf("UDPSession.kcp isn't *KCP")
+	}
+	k := f.Type.Elem()
+	for _, name := range []string{"rx_srtt", "rx_rttvar", "rx_rto", "snd_wnd", "rcv_wnd", "rmt_wnd", "cwnd", "nocwnd"} {
+		if f, ok := k.FieldByName(name); !ok || !isIntKind(f.Type.Kind()) {
+			return fmt.Errorf("KCP.%s isn't integer", name)
+		}
+	}
+	for _, name := range []string{"snd_buf", "snd_queue", "rcv_buf"} {
+		if f, ok := k.FieldByName(name); !ok || f.Type.Kind() != reflect.Slice {
+			return fmt.Errorf("KCP.%s isn't slice", name)
+		}
+	}
+	sndBuf, _ := k.FieldByName("snd_buf")
+	seg := sndBuf.Type.Elem()
+	if seg.Kind() != reflect.Struct {
+		return fmt.Errorf("element of KCP.snd_buf isn't struct")
+	}
+	if f, ok := seg.FieldByName("xmit"); !ok || !isIntKind(f.Type.Kind()) {
+		return fmt.Errorf("segment.xmit isn't integer")
+	}
+	return nil
+}
+
+// kcpSessionStats reads state of sess, returns nil if it's not available.
+// kcp-go v5.4 doesn't export the state, so read it from unexported fields under lock of the session.
+func kcpSessionStats(sess *kcp.UDPSession) *KCPStats {
+	if kcpStatsErr != nil {
+		return nil
+	}
+	v := reflect.ValueOf(sess).Elem()
+	mu, k := v.FieldByName("mu"), v.FieldByName("kcp")
+	if k.IsNil() {
+		return nil
+	}
+	lock := (*sync.Mutex)(unsafe.Pointer(mu.UnsafeAddr()))
+	lock.Lock()
+	defer lock.Unlock()
+
+	k = k.Elem()
+	stats := &KCPStats{
+		SRTT:   intField(k, "rx_srtt"),
+		RTTVar: intField(k, "rx_rttvar"),
+		RTO:    intField(k, "rx_rto"),
+		SndWnd: intField(k, "snd_wnd"),
+		RcvWnd: intField(k, "rcv_wnd"),
+		RmtWnd: intField(k, "rmt_wnd"),
+		Cwnd:   intField(k, "cwnd"),
+	}
+	sndBuf := k.FieldByName("snd_buf")
+	stats.SndBuf = sndBuf.Len()
+	for i := 0; i < stats.SndBuf; i++ {
+		if intField(sndBuf.Index(i), "xmit") > 1 {
+			stats.Retrans++
+		}
+	}
+	stats.SndQueue = k.FieldByName("snd_queue").Len()
+	stats.RcvBuf = k.FieldByName("rcv_buf").Len()
+
+	// same as flush of kcp
+	wnd := stats.SndWnd
+	if stats.RmtWnd < wnd {
+		wnd = stats.RmtWnd
+	}
+	if intField(k, "nocwnd") == 0 && stats.Cwnd < wnd {
+		wnd = stats.Cwnd
+	}
+	if wnd > 0 {
+		stats.WndUsage = float64(stats.SndBuf) / float64(wnd)
+	}
+	return stats
+}
+
+var kcpSnmpMetrics = []struct {
+	name      string
+	help      string
+	valueType prometheus.ValueType
+	value     func(s *kcp.Snmp) uint64
+}{
+	{"bytes_sent", "bytes sent from upper level", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.BytesSent }},
+	{"bytes_received", "bytes received to upper level", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.BytesReceived }},
+	{"max_conn", "max number of connections ever reached", prometheus.GaugeValue, func(s *kcp.Snmp) uint64 { return s.MaxConn }},
+	{"active_opens", "accumulated active open connections", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.ActiveOpens }},
+	{"passive_opens", "accumulated passive open connections", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.PassiveOpens }},
+	{"curr_estab", "current number of established connections", prometheus.GaugeValue, func(s *kcp.Snmp) uint64 { return s.CurrEstab }},
+	{"in_errs", "udp read errors", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.InErrs }},
+	{"in_csum_errors", "checksum errors from crc32", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.InCsumErrors }},
+	{"kcp_in_errors", "packet input errors reported from kcp", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.KCPInErrors }},
+	{"in_pkts", "incoming packets", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.InPkts }},
+	{"out_pkts", "outgoing packets", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.OutPkts }},
+	{"in_segs", "incoming kcp segments", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.InSegs }},
+	{"out_segs", "outgoing kcp segments", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.OutSegs }},
+	{"in_bytes", "udp bytes received", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.InBytes }},
+	{"out_bytes", "udp bytes sent", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.OutBytes }},
+	{"retrans_segs", "accumulated retransmitted segments", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.RetransSegs }},
+	{"fast_retrans_segs", "accumulated fast retransmitted segments", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.FastRetransSegs }},
+	{"early_retrans_segs", "accumulated early retransmitted segments", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.EarlyRetransSegs }},
+	{"lost_segs", "number of segments inferred as lost", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.LostSegs }},
+	{"repeat_segs", "number of segments duplicated", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.RepeatSegs }},
+	{"fec_recovered", "correct packets recovered from fec", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.FECRecovered }},
+	{"fec_errs", "incorrect packets recovered from fec", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.FECErrs }},
+	{"fec_parity_shards", "fec segments received", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.FECParityShards }},
+	{"fec_short_shards", "number of data shards not enough for recovery", prometheus.CounterValue, func(s *kcp.Snmp) uint64 { return s.FECShortShards }},
+}
+
+var kcpSessionMetrics = []struct {
+	name  string
+	help  string
+	value func(s *KCPStats) float64
+}{
+	{"srtt_ms", "smoothed rtt of kcp sessions", func(s *KCPStats) float64 { return float64(s.SRTT) }},
+	{"rto_ms", "rto of kcp sessions", func(s *KCPStats) float64 { return float64(s.RTO) }},
+	{"wnd_usage", "usage of send window of kcp sessions", func(s *KCPStats) float64 { return s.WndUsage }},
+	{"retrans_segs", "unacked segments retransmitted of kcp sessions", func(s *KCPStats) float64 { return float64(s.Retrans) }},
+}
+
+var kcpSessionQuantiles = []float64{0.5, 0.9, 0.99}
+
+// kcpCollector collects kcp snmp, and summaries of live kcp sessions when scraped.
+// Summaries are disabled if kcpStatsErr is set.
+type kcpCollector struct {
+	snmpDescs    []*prometheus.Desc
+	sessionDescs []*prometheus.Desc
+}
+
+func newKCPCollector() *kcpCollector {
+	c := &kcpCollector{}
+	for _, m := range kcpSnmpMetrics {
+		c.snmpDescs = append(c.snmpDescs, prometheus.NewDesc("goscon_kcp_snmp_"+m.name, m.help, nil, nil))
+	}
+	for _, m := range kcpSessionMetrics {
+		if kcpStatsErr != nil {
+			break
+		}
+		c.sessionDescs = append(c.sessionDescs, prometheus.NewDesc("goscon_kcp_session_"+m.name, m.help, nil, nil))
+	}
+	return c
+}
+
+// Describe implements prometheus.Collector
+func (c *kcpCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.snmpDescs {
+		ch <- desc
+	}
+	for _, desc := range c.sessionDescs {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *kcpCollector) Collect(ch chan<- prometheus.Metric) {
+	snmp := kcp.DefaultSnmp.Copy()
+	for i, m := range kcpSnmpMetrics {
+		ch <- prometheus.MustNewConstMetric(c.snmpDescs[i], m.valueType, float64(m.value(snmp)))
+	}
+
+	if len(c.sessionDescs) == 0 {
+		return
+	}
+	var stats []*KCPStats
+	for _, pair := range defaultServer.pairs() {
+		if sess := kcpSessionOf(pair.RemoteConn.Current().RawConn()); sess != nil {
+			if s := kcpSessionStats(sess); s != nil {
+				stats = append(stats, s)
+			}
+		}
+	}
+	values := make([]float64, len(stats))
+	for i, m := range kcpSessionMetrics {
+		var sum float64
+		for j, s := range stats {
+			values[j] = m.value(s)
+			sum += values[j]
+		}
+		sort.Float64s(values)
+		quantiles := make(map[float64]float64)
+		if len(values) > 0 {
+			for _, q := range kcpSessionQuantiles {
+				quantiles[q] = values[int(q*float64(len(values)-1))]
+			}
+		}
+		ch <- prometheus.MustNewConstSummary(c.sessionDescs[i], uint64(len(values)), sum, quantiles)
+	}
+}
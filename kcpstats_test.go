@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/xtaci/kcp-go"
+)
+
+func TestKCPStatsLayout(t *testing.T) {
+	// fails if kcp-go is upgraded and fields read by kcpSessionStats are changed
+	if kcpStatsErr != nil {
+		t.Fatalf("layout of kcp-go: %s", kcpStatsErr.Error())
+	}
+}
+
+func TestKCPSessionStats(t *testing.T) {
+	l, err := kcp.ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := kcp.DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetWindowSize(16, 64)
+
+	// the first packet makes the session accepted
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	l.SetDeadline(time.Now().Add(5 * time.Second))
+	server, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(server, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	// server doesn't read any more, so client writes until windows are full
+	data := make([]byte, 1024)
+	client.SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
+	for i := 0; i < 1024; i++ {
+		if _, err := client.Write(data); err != nil {
+			break
+		}
+	}
+
+	stats := kcpSessionStats(client)
+	if stats == nil {
+		t.Fatal("no stats")
+	}
+	cases := []struct {
+		name string
+		ok   bool
+	}{
+		{"snd_wnd", stats.SndWnd == 16},
+		{"rcv_wnd", stats.RcvWnd == 64},
+		{"rmt_wnd", stats.RmtWnd < kcp.IKCP_WND_RCV}, // data unread by server
+		{"rto", stats.RTO > 0},
+		{"cwnd", stats.Cwnd > 0},
+		{"unacked", stats.SndBuf+stats.SndQueue > 0},
+		{"wnd_usage", stats.WndUsage > 0 && stats.WndUsage <= 1},
+	}
+	for _, c := range cases {
+		if !c.ok {
+			t.Errorf("%s: %+v", c.name, stats)
+		}
+	}
+}
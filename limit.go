@@ -0,0 +1,220 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ejoy/goscon/scp"
+	"github.com/xjdrew/glog"
+)
+
+// reasons of rejecting conn
+const (
+	rejectDraining         = "draining"
+	rejectUpgrading        = "upgrading"
+	rejectBanned           = "banned"
+	rejectACLDeny          = "acl_deny"
+	rejectACLNotAllowed    = "acl_not_allowed"
+	rejectMaxSessions      = "max_sessions"
+	rejectMaxSessionsPerIP = "max_sessions_per_ip"
+	rejectHandshakeRate    = "handshake_rate"
+)
+
+// interval to remove idle token buckets
+const limiterSweepInterval = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills bucket by rate and takes a token, reports whether succeed
+func (b *tokenBucket) take(now time.Time, rate float64, burst float64) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// connLimiter limits sessions and handshakes of clients, clients are grouped by ip prefix
+type connLimiter struct {
+	mu        sync.Mutex
+	total     int
+	sessions  map[string]int
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+var defaultLimiter = &connLimiter{
+	sessions: make(map[string]int),
+	buckets:  make(map[string]*tokenBucket),
+}
+
+func maskBits(name string, max int) int {
+	bits := configItemInt(name)
+	if bits <= 0 || bits > max {
+		return max
+	}
+	return bits
+}
+
+// limitKey returns ip prefix of addr, by limit.ipv4_prefix or limit.ipv6_prefix
+func limitKey(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(maskBits("limit.ipv4_prefix", 32), 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(maskBits("limit.ipv6_prefix", 128), 128)).String()
+}
+
+// allowHandshake takes a token from bucket of addr
+func (l *connLimiter) allowHandshake(addr net.Addr) bool {
+	rate := float64(configItemInt("limit.handshake_rate"))
+	if rate <= 0 {
+		return true
+	}
+	burst := float64(configItemInt("limit.handshake_burst"))
+	if burst < 1 {
+		burst = 1
+	}
+	key := limitKey(addr)
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// buckets refilled to full are the same as new ones
+	if now.Sub(l.lastSweep) > limiterSweepInterval {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rate >= burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	return b.take(now, rate, burst)
+}
+
+// reserveSession counts a new session of addr if it doesn't exceed limits,
+// returns key to remove it, or reason if exceeds
+func (l *connLimiter) reserveSession(addr net.Addr) (string, string) {
+	maxSessions := configItemInt("limit.max_sessions")
+	maxSessionsPerIP := configItemInt("limit.max_sessions_per_ip")
+	key := limitKey(addr)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if maxSessions > 0 && l.total >= maxSessions {
+		return "", rejectMaxSessions
+	}
+	if maxSessionsPerIP > 0 && l.sessions[key] >= maxSessionsPerIP {
+		return "", rejectMaxSessionsPerIP
+	}
+	l.total++
+	l.sessions[key]++
+	return key, ""
+}
+
+// addSession counts a session of addr regardless of limits, e.g. a session handed over, returns key to remove it
+func (l *connLimiter) addSession(addr net.Addr) string {
+	key := limitKey(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total++
+	l.sessions[key]++
+	return key
+}
+
+func (l *connLimiter) removeSession(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.sessions[key] <= 1 {
+		delete(l.sessions, key)
+	} else {
+		l.sessions[key]--
+	}
+}
+
+// AcceptNewConn implements scp.NewConnFilter interface
+func (ss *SCPServer) AcceptNewConn(scon *scp.Conn) *scp.Error {
+	if ss.isDraining() {
+		connectionRejects.WithLabelValues(rejectDraining).Inc()
+		return scp.ErrServiceUnavailable
+	}
+	// sessions are taken by new process soon
+	if ss.isHandingOver() {
+		connectionRejects.WithLabelValues(rejectUpgrading).Inc()
+		return scp.ErrServiceUnavailable
+	}
+	if serr := checkMaintenance(scon.TargetServer()); serr != nil {
+		connectionRejects.WithLabelValues(rejectMaintenance).Inc()
+		if glog.V(1) {
+			glog.Infof("reject conn: client=%s, target=%s, reason=%s", scon.RemoteAddr(), scon.TargetServer(), rejectMaintenance)
+		}
+		return serr
+	}
+	if reason := defaultOverloadGuard.check(); reason != "" {
+		connectionRejects.WithLabelValues(reason).Inc()
+		if glog.V(1) {
+			glog.Infof("reject conn: client=%s, reason=%s", scon.RemoteAddr(), reason)
+		}
+		return overloadError()
+	}
+	// slot is reserved here, taken by the pair or released if handshake fails
+	key, reason := defaultLimiter.reserveSession(scon.RemoteAddr())
+	if reason != "" {
+		connectionRejects.WithLabelValues(reason).Inc()
+		if glog.V(1) {
+			glog.Infof("reject conn: client=%s, reason=%s", scon.RemoteAddr(), reason)
+		}
+		return scp.ErrTooManyRequests
+	}
+	ss.reservedMutex.Lock()
+	ss.reserved[scon] = key
+	ss.reservedMutex.Unlock()
+	return nil
+}
+
+// takeReserved returns limit key of session reserved by AcceptNewConn, the session is counted if not reserved
+func (ss *SCPServer) takeReserved(scon *scp.Conn) string {
+	ss.reservedMutex.Lock()
+	key, ok := ss.reserved[scon]
+	delete(ss.reserved, scon)
+	ss.reservedMutex.Unlock()
+	if !ok {
+		key = defaultLimiter.addSession(scon.RemoteAddr())
+	}
+	return key
+}
+
+// releaseReserved removes session reserved by AcceptNewConn, if handshake fails after it
+func (ss *SCPServer) releaseReserved(scon *scp.Conn) {
+	ss.reservedMutex.Lock()
+	key, ok := ss.reserved[scon]
+	delete(ss.reserved, scon)
+	ss.reservedMutex.Unlock()
+	if ok {
+		defaultLimiter.removeSession(key)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// setConfigItems overrides cached config items, returns func to restore them
+func setConfigItems(items map[string]interface{}) func() {
+	configMu.Lock()
+	defer configMu.Unlock()
+	for k, v := range items {
+		configCache[k] = v
+	}
+	return func() {
+		configMu.Lock()
+		defer configMu.Unlock()
+		for k := range items {
+			delete(configCache, k)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := &tokenBucket{tokens: 2, last: now}
+
+	// burst
+	if !b.take(now, 1, 2) || !b.take(now, 1, 2) {
+		t.Fatal("burst tokens not taken")
+	}
+	if b.take(now, 1, 2) {
+		t.Fatal("token taken from empty bucket")
+	}
+	// refilled by rate
+	now = now.Add(500 * time.Millisecond)
+	if b.take(now, 1, 2) {
+		t.Fatal("token taken before refilled")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if !b.take(now, 1, 2) {
+		t.Fatal("token not refilled")
+	}
+	// no more than burst after idle
+	now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if !b.take(now, 1, 2) {
+			t.Fatalf("take %d after idle failed", i)
+		}
+	}
+	if b.take(now, 1, 2) {
+		t.Fatal("bucket exceeds burst")
+	}
+}
+
+func TestConnLimiterHandshake(t *testing.T) {
+	defer setConfigItems(map[string]interface{}{
+		"limit.handshake_rate":  1,
+		"limit.handshake_burst": 2,
+		"limit.ipv4_prefix":     24,
+	})()
+
+	l := &connLimiter{sessions: make(map[string]int), buckets: make(map[string]*tokenBucket)}
+	a1 := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+	a2 := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2} // same prefix as a1
+	a3 := &net.TCPAddr{IP: net.ParseIP("10.0.1.1"), Port: 3}
+
+	if !l.allowHandshake(a1) || !l.allowHandshake(a2) {
+		t.Fatal("handshakes within burst are refused")
+	}
+	if l.allowHandshake(a1) {
+		t.Error("handshake of the same prefix exceeds burst")
+	}
+	if !l.allowHandshake(a3) {
+		t.Error("handshake of other prefix is refused")
+	}
+}
+
+func TestConnLimiterSessions(t *testing.T) {
+	defer setConfigItems(map[string]interface{}{
+		"limit.max_sessions":        3,
+		"limit.max_sessions_per_ip": 2,
+		"limit.ipv4_prefix":         32,
+	})()
+
+	l := &connLimiter{sessions: make(map[string]int), buckets: make(map[string]*tokenBucket)}
+	a1 := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+	a2 := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2}
+
+	k1, reason := l.reserveSession(a1)
+	if reason != "" {
+		t.Fatalf("reserve: %s", reason)
+	}
+	if _, reason = l.reserveSession(a1); reason != "" {
+		t.Fatalf("reserve: %s", reason)
+	}
+	if _, reason = l.reserveSession(a1); reason != rejectMaxSessionsPerIP {
+		t.Errorf("reserve over per ip limit: %q", reason)
+	}
+	if _, reason = l.reserveSession(a2); reason != "" {
+		t.Fatalf("reserve: %s", reason)
+	}
+	if _, reason = l.reserveSession(a2); reason != rejectMaxSessions {
+		t.Errorf("reserve over total limit: %q", reason)
+	}
+
+	// sessions handed over are counted regardless of limits
+	k2 := l.addSession(a2)
+	if l.total != 4 || l.sessions[k2] != 2 {
+		t.Errorf("sessions: total=%d, %s=%d", l.total, k2, l.sessions[k2])
+	}
+	l.removeSession(k2)
+
+	l.removeSession(k1)
+	if _, reason = l.reserveSession(a2); reason != "" {
+		t.Errorf("reserve after removed: %s", reason)
+	}
+	if l.total != 3 || l.sessions[k1] != 1 {
+		t.Errorf("sessions: total=%d, %s=%d", l.total, k1, l.sessions[k1])
+	}
+}
+
+func TestConnLimiterConcurrent(t *testing.T) {
+	defer setConfigItems(map[string]interface{}{
+		"limit.max_sessions":        10,
+		"limit.max_sessions_per_ip": 0,
+	})()
+
+	l := &connLimiter{sessions: make(map[string]int), buckets: make(map[string]*tokenBucket)}
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+	results := make(chan string, 100)
+	for i := 0; i < 100; i++ {
+		go func() {
+			_, reason := l.reserveSession(addr)
+			results <- reason
+		}()
+	}
+	reserved := 0
+	for i := 0; i < 100; i++ {
+		if <-results == "" {
+			reserved++
+		}
+	}
+	if reserved != 10 || l.total != 10 {
+		t.Errorf("reserved=%d, total=%d, want 10", reserved, l.total)
+	}
+}
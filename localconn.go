@@ -59,6 +59,7 @@ func (c *LocalSCPConn) startWait() {
 // NewLocalSCPConn .
 func NewLocalSCPConn(scon *scp.Conn) *LocalSCPConn {
 	scpConn := NewSCPConn(scon)
+	scpConn.side = sideUpstream
 	localSCPConn := &LocalSCPConn{SCPConn: scpConn}
 	return localSCPConn
 }
@@ -10,7 +10,9 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 
 	"github.com/spf13/viper"
 	"github.com/xjdrew/glog"
@@ -66,6 +68,11 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := inheritListeners(); err != nil {
+		glog.Errorf("inherit listeners failed: err=%s", err.Error())
+		os.Exit(1)
+	}
+
 	if err := startManager(viper.GetString("manager")); err != nil {
 		glog.Errorf("start manager failed: err=%s", err.Error())
 		os.Exit(1)
@@ -94,6 +101,9 @@ func main() {
 
 	kcpListen := viper.GetString("kcp")
 	if kcpListen != "" {
+		if kcpStatsErr != nil {
+			glog.Errorf("kcp session stats disabled: err=%s", kcpStatsErr.Error())
+		}
 		reuseport := viper.GetInt("kcp_option.reuseport")
 		if reuseport <= 0 {
 			reuseport = 1
@@ -115,6 +125,45 @@ func main() {
 			}(l)
 		}
 	}
-	wg.Wait()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	upgradeCh := notifyUpgrade()
+
+	// restore sessions from old process if started by upgrade, signals are handled meanwhile
+	go resumeSessions()
+
+	serveDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(serveDone)
+	}()
+Loop:
+	for {
+		select {
+		case sig := <-sigCh:
+			glog.Infof("receive signal, shutdown: signal=%s", sig)
+			force := make(chan struct{})
+			go func() {
+				sig := <-sigCh
+				glog.Infof("receive signal again, force shutdown: signal=%s", sig)
+				close(force)
+			}()
+			defaultServer.Shutdown(configItemTime("drain_timeout"), force)
+			break Loop
+		case sig := <-upgradeCh:
+			glog.Infof("receive signal, upgrade: signal=%s", sig)
+			done, err := upgrade()
+			if err != nil {
+				glog.Errorf("upgrade failed: err=%s", err.Error())
+			}
+			if !done {
+				continue
+			}
+			break Loop
+		case <-serveDone:
+			break Loop
+		}
+	}
 	glog.Flush()
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ejoy/goscon/scp"
+	"github.com/ejoy/goscon/upstream"
+	"github.com/xjdrew/glog"
+)
+
+const rejectMaintenance = "maintenance"
+
+var errInvalidMaintenanceMessage = errors.New("maintenance message contains line break")
+
+// validMaintenanceMessage reports whether message fits in one line of handshake response
+func validMaintenanceMessage(message string) bool {
+	return !strings.ContainsAny(message, "\r\n")
+}
+
+// MaintenanceTarget is a targetServer or host group in maintenance
+type MaintenanceTarget struct {
+	Name    string
+	Message string
+}
+
+// MaintenanceOption .
+type MaintenanceOption struct {
+	Enabled bool   // all new sessions are refused
+	Message string // sent to client with status 423
+	Targets []MaintenanceTarget
+}
+
+func (o *MaintenanceOption) validate() error {
+	if !validMaintenanceMessage(o.Message) {
+		return errInvalidMaintenanceMessage
+	}
+	for _, target := range o.Targets {
+		if !validMaintenanceMessage(target.Message) {
+			return errInvalidMaintenanceMessage
+		}
+	}
+	return nil
+}
+
+// MaintenanceStatus is current state of maintenance, new sessions to targets are refused
+type MaintenanceStatus struct {
+	Enabled bool              `json:"enabled"`
+	Message string            `json:"message,omitempty"`
+	Targets map[string]string `json:"targets"` // name of targetServer or host group in lower case -> message
+}
+
+var (
+	maintenanceMu     sync.Mutex // serialize modifying maintenance
+	maintenanceStatus atomic.Value
+)
+
+func init() {
+	maintenanceStatus.Store(&MaintenanceStatus{Targets: map[string]string{}})
+}
+
+func newMaintenanceStatus(option *MaintenanceOption) *MaintenanceStatus {
+	status := &MaintenanceStatus{
+		Enabled: option.Enabled,
+		Message: option.Message,
+		Targets: make(map[string]string),
+	}
+	for _, target := range option.Targets {
+		status.Targets[strings.ToLower(target.Name)] = target.Message
+	}
+	return status
+}
+
+// storeMaintenance makes status effective, hosts of groups in maintenance are excluded from random choice,
+// so that sessions without preferred hosts don't fall back to them
+func storeMaintenance(status *MaintenanceStatus) {
+	maintenanceStatus.Store(status)
+	groups := make([]string, 0, len(status.Targets))
+	for name := range status.Targets {
+		groups = append(groups, name)
+	}
+	upstream.SetExcludedGroups(groups)
+}
+
+// setMaintenance replaces state from config, changes by manager are discarded
+func setMaintenance(option *MaintenanceOption) {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	storeMaintenance(newMaintenanceStatus(option))
+}
+
+// modifyMaintenance enables or disables maintenance of target, or globally if target is empty
+func modifyMaintenance(target string, enabled bool, message string) {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	old := maintenanceStatus.Load().(*MaintenanceStatus)
+	status := &MaintenanceStatus{
+		Enabled: old.Enabled,
+		Message: old.Message,
+		Targets: make(map[string]string, len(old.Targets)),
+	}
+	for k, v := range old.Targets {
+		status.Targets[k] = v
+	}
+	target = strings.ToLower(target)
+	switch {
+	case target == "":
+		status.Enabled = enabled
+		status.Message = message
+	case enabled:
+		status.Targets[target] = message
+	default:
+		delete(status.Targets, target)
+	}
+	storeMaintenance(status)
+}
+
+// checkMaintenance returns error if new session to targetServer is refused,
+// targetServer is matched by its name, then by the host group it's routed to, case insensitive
+func checkMaintenance(targetServer string) *scp.Error {
+	status := maintenanceStatus.Load().(*MaintenanceStatus)
+	message, ok := status.Message, status.Enabled
+	if !ok && len(status.Targets) > 0 {
+		if message, ok = status.Targets[strings.ToLower(targetServer)]; !ok {
+			if group := upstream.GroupOf(targetServer); group != "" {
+				message, ok = status.Targets[strings.ToLower(group)]
+			}
+		}
+	}
+	if !ok {
+		return nil
+	}
+	if message == "" {
+		return scp.ErrMaintenance
+	}
+	return &scp.Error{Code: scp.SCPStatusMaintenance, Desc: message}
+}
+
+func showMaintenance(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(maintenanceStatus.Load().(*MaintenanceStatus))
+}
+
+// setMaintenanceHandler enables or disables maintenance of target, or globally if target is empty.
+// It's valid until next reload.
+func setMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	enabled, err := strconv.ParseBool(r.FormValue("enable"))
+	if err != nil {
+		io.WriteString(w, "failed: "+errInvalidParameter.Error())
+		return
+	}
+	target := r.FormValue("target")
+	message := r.FormValue("message")
+	if !validMaintenanceMessage(message) {
+		io.WriteString(w, "failed: "+errInvalidMaintenanceMessage.Error())
+		return
+	}
+	modifyMaintenance(target, enabled, message)
+	glog.Infof("set maintenance: target=%s, enable=%v, message=%s, caller=%s", target, enabled, message, callerOf(r))
+	io.WriteString(w, "succeed")
+}
+
+func registerMaintenanceHandlers() {
+	http.HandleFunc("/maintenance", showMaintenance)
+	http.HandleFunc("/maintenance/set", setMaintenanceHandler)
+}
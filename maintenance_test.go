@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ejoy/goscon/scp"
+)
+
+func TestCheckMaintenance(t *testing.T) {
+	defer setMaintenance(&MaintenanceOption{})
+
+	setMaintenance(&MaintenanceOption{
+		Targets: []MaintenanceTarget{{Name: "Game1", Message: "back at 10:00"}},
+	})
+	// targets are case insensitive
+	for _, target := range []string{"game1", "GAME1"} {
+		if serr := checkMaintenance(target); serr == nil || serr.Desc != "back at 10:00" {
+			t.Errorf("%s: %v", target, serr)
+		}
+	}
+	if serr := checkMaintenance("game2"); serr != nil {
+		t.Errorf("game2: %v", serr)
+	}
+
+	modifyMaintenance("GAME1", false, "")
+	if serr := checkMaintenance("game1"); serr != nil {
+		t.Errorf("game1 after disabled: %v", serr)
+	}
+
+	modifyMaintenance("", true, "")
+	if serr := checkMaintenance("game2"); serr != scp.ErrMaintenance {
+		t.Errorf("global: %v", serr)
+	}
+}
+
+func TestMaintenanceMessage(t *testing.T) {
+	defer setMaintenance(&MaintenanceOption{})
+
+	cases := []struct {
+		option MaintenanceOption
+		err    error
+	}{
+		{MaintenanceOption{Enabled: true, Message: "back at 10:00"}, nil},
+		{MaintenanceOption{Enabled: true, Message: "back\nat 10:00"}, errInvalidMaintenanceMessage},
+		{MaintenanceOption{Targets: []MaintenanceTarget{{Name: "game1", Message: "back\r"}}}, errInvalidMaintenanceMessage},
+	}
+	for i, c := range cases {
+		if err := c.option.validate(); err != c.err {
+			t.Errorf("case %d: %v, want %v", i, err, c.err)
+		}
+	}
+
+	for _, message := range []string{"back\nat 10:00", "back\r\n"} {
+		w := httptest.NewRecorder()
+		form := url.Values{"enable": {"true"}, "target": {"game1"}, "message": {message}}
+		setMaintenanceHandler(w, httptest.NewRequest(http.MethodPost, "/maintenance/set?"+form.Encode(), nil))
+		if !strings.HasPrefix(w.Body.String(), "failed") {
+			t.Errorf("%q: %s", message, w.Body.String())
+		}
+		if serr := checkMaintenance("game1"); serr != nil {
+			t.Errorf("%q: maintenance set: %v", message, serr)
+		}
+	}
+}
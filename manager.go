@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"io"
 	"net"
@@ -11,23 +12,50 @@ import (
 	"github.com/xtaci/kcp-go"
 )
 
+// listener of manager, handed over when upgrading
+var managerListener net.Listener
+var managerAddr string
+
 func startManager(laddr string) (err error) {
 	if laddr == "" {
 		return
 	}
-	ln, err := net.Listen("tcp", laddr)
+	var ln net.Listener
+	if f := inheritedFile("manager", laddr); f != nil {
+		ln, err = net.FileListener(f)
+		f.Close()
+	} else {
+		ln, err = net.Listen("tcp", laddr)
+	}
 	if err != nil {
 		glog.Infof("start manager failed: listen=%s, err=%s", laddr, err.Error())
 		return
 	}
-	glog.Infof("start manager: listen=%s", laddr)
+	managerListener = ln
+	managerAddr = laddr
+
+	option := managerOption.Load().(*ManagerOption)
+	if option.TLSCert != "" && option.TLSKey != "" {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(option.TLSCert, option.TLSKey); err != nil {
+			glog.Errorf("load manager certificate failed: cert=%s, key=%s, err=%s", option.TLSCert, option.TLSKey, err.Error())
+			return
+		}
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+	glog.Infof("start manager: listen=%s, tls=%v, users=%d", laddr, option.TLSCert != "" && option.TLSKey != "", len(option.Users))
 
 	http.HandleFunc("/config", func(w http.ResponseWriter, _ *http.Request) {
 		w.Header().Add("Content-Type", "text/vnd.yaml")
 		io.WriteString(w, marshalConfigFile())
 	})
 
-	http.HandleFunc("/reload", func(w http.ResponseWriter, _ *http.Request) {
+	http.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		glog.Infof("reload config: caller=%s", callerOf(r))
 		err := reloadConfig()
 		if err == nil {
 			io.WriteString(w, "succeed")
@@ -42,11 +70,22 @@ func startManager(laddr string) (err error) {
 		enc.Encode(kcp.DefaultSnmp.Copy())
 	})
 
+	http.HandleFunc("/drain", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.Encode(defaultServer.DrainStatus())
+	})
+
+	registerUpstreamHandlers()
+	registerSessionHandlers()
+	registerBanHandlers()
+	registerMaintenanceHandlers()
+
 	http.Handle("/metrics", promhttp.Handler())
 
 	go func() {
 		defer ln.Close()
-		err := http.Serve(ln, nil)
+		err := http.Serve(ln, managerHandler{http.DefaultServeMux})
 		glog.Errorf("manager exit: err=%v", err)
 	}()
 	return nil
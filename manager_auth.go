@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/xjdrew/glog"
+)
+
+// roles of manager user
+const (
+	roleReadonly = "readonly"
+	roleAdmin    = "admin"
+)
+
+// paths require admin role, a path ends with '/' matches by prefix
+var adminPaths = []string{
+	"/config",
+	"/reload",
+	"/upstream/hosts/",
+	"/sessions/kick",
+	"/bans",
+	"/bans/clear",
+	"/maintenance/set",
+	"/debug/",
+}
+
+var errInvalidManagerUser = errors.New("invalid manager user")
+
+// ManagerUser authenticates by http basic auth with name and password, or by bearer token.
+// Name is required for both, which identifies caller in log.
+type ManagerUser struct {
+	Name     string
+	Password string
+	Token    string
+	Role     string
+}
+
+// ManagerOption .
+type ManagerOption struct {
+	TLSCert string `mapstructure:"tls_cert"`
+	TLSKey  string `mapstructure:"tls_key"`
+	Users   []ManagerUser
+}
+
+func (o *ManagerOption) validate() error {
+	for _, u := range o.Users {
+		if u.Role != roleReadonly && u.Role != roleAdmin {
+			return errInvalidManagerUser
+		}
+		if u.Name == "" || (u.Token == "" && u.Password == "") {
+			return errInvalidManagerUser
+		}
+	}
+	return nil
+}
+
+var managerOption atomic.Value // *ManagerOption
+
+func init() {
+	managerOption.Store(&ManagerOption{})
+}
+
+type managerUserKey struct{}
+
+func requiredRole(path string) string {
+	for _, p := range adminPaths {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return roleAdmin
+		}
+	}
+	return roleReadonly
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func authenticate(r *http.Request, users []ManagerUser) *ManagerUser {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		for i := range users {
+			if users[i].Token != "" && secureEqual(users[i].Token, token) {
+				return &users[i]
+			}
+		}
+		return nil
+	}
+
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return nil
+	}
+	for i := range users {
+		if users[i].Name == name && users[i].Password != "" && secureEqual(users[i].Password, password) {
+			return &users[i]
+		}
+	}
+	return nil
+}
+
+// managerHandler checks authentication and role before serving, authentication is disabled if no user
+type managerHandler struct {
+	http.Handler
+}
+
+func (h managerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	option := managerOption.Load().(*ManagerOption)
+	if len(option.Users) > 0 {
+		user := authenticate(r, option.Users)
+		if user == nil {
+			glog.Errorf("manager unauthorized: path=%s, caller=%s", r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Basic realm="goscon"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if requiredRole(r.URL.Path) == roleAdmin && user.Role != roleAdmin {
+			glog.Errorf("manager forbidden: path=%s, user=%s, caller=%s", r.URL.Path, user.Name, r.RemoteAddr)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), managerUserKey{}, user.Name))
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+// callerOf returns identity of caller for logging
+func callerOf(r *http.Request) string {
+	if name, ok := r.Context().Value(managerUserKey{}).(string); ok {
+		return name + "@" + r.RemoteAddr
+	}
+	return r.RemoteAddr
+}
+
+// redactConfig hides password and token of manager users
+func redactConfig(c map[string]interface{}) {
+	option, ok := c["manager_option"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	users, ok := option["users"].([]interface{})
+	if !ok {
+		return
+	}
+
+	redacted := make([]interface{}, len(users))
+	for i, u := range users {
+		m := make(map[string]interface{})
+		switch u := u.(type) {
+		case map[interface{}]interface{}:
+			for k, v := range u {
+				m[k.(string)] = v
+			}
+		case map[string]interface{}:
+			for k, v := range u {
+				m[k] = v
+			}
+		}
+		for _, k := range []string{"password", "token"} {
+			if _, ok := m[k]; ok {
+				m[k] = "******"
+			}
+		}
+		redacted[i] = m
+	}
+	option["users"] = redacted
+}
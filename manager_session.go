@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/xjdrew/glog"
+)
+
+const (
+	defaultSessionLimit = 100
+	maxSessionLimit     = 1000
+)
+
+// state of session
+const (
+	sessionConnecting = "connecting" // connecting to upstream
+	sessionActive     = "active"
+	sessionWaiting    = "waiting" // waiting for reuse
+	sessionSuspending = "suspending"
+)
+
+// SessionInfo is summary of a connPair
+type SessionInfo struct {
+	ID           int       `json:"id"`
+	Transport    string    `json:"transport"`
+	ClientAddr   string    `json:"client_addr"`
+	UpstreamAddr string    `json:"upstream_addr"`
+	Host         string    `json:"host"`
+	TargetServer string    `json:"target_server"`
+	State        string    `json:"state"`
+	Reuses       int64     `json:"reuses"`
+	C2SBytes     int64     `json:"c2s_bytes"`
+	C2SPackets   int64     `json:"c2s_packets"`
+	S2CBytes     int64     `json:"s2c_bytes"`
+	S2CPackets   int64     `json:"s2c_packets"`
+	CreatedAt    time.Time `json:"created_at"`
+	Age          int64     `json:"age"` // seconds
+}
+
+// SessionDetail is detail of a connPair
+type SessionDetail struct {
+	SessionInfo
+	ClientLocalAddr   string `json:"client_local_addr"`
+	UpstreamLocalAddr string `json:"upstream_local_addr"`
+	UpstreamNet       string `json:"upstream_net"`
+	HostAddr          string `json:"host_addr"`
+	Flag              int    `json:"flag"`
+	ReuseBufferLen    int    `json:"reuse_buffer_len"`
+	ReuseBufferSize   int    `json:"reuse_buffer_size"`
+
+	KCP *KCPStats `json:"kcp,omitempty"` // nil if client is not kcp
+}
+
+// SessionList is a page of sessions
+type SessionList struct {
+	Total    int            `json:"total"`
+	Offset   int            `json:"offset"`
+	Limit    int            `json:"limit"`
+	Sessions []*SessionInfo `json:"sessions"`
+}
+
+func transportOf(conn net.Conn) string {
+	if conn.LocalAddr().Network() == "udp" {
+		return "kcp"
+	}
+	return "tcp"
+}
+
+func (p *connPair) info(now time.Time) *SessionInfo {
+	scon := p.RemoteConn.Current()
+	info := &SessionInfo{
+		ID:           scon.ID(),
+		Transport:    transportOf(scon.RawConn()),
+		ClientAddr:   scon.RemoteAddr().String(),
+		TargetServer: scon.TargetServer(),
+		Reuses:       atomic.LoadInt64(&p.reuses),
+		C2SBytes:     atomic.LoadInt64(&p.c2sBytes),
+		C2SPackets:   atomic.LoadInt64(&p.c2sPackets),
+		S2CBytes:     atomic.LoadInt64(&p.s2cBytes),
+		S2CPackets:   atomic.LoadInt64(&p.s2cPackets),
+		CreatedAt:    p.createdAt,
+		Age:          int64(now.Sub(p.createdAt) / time.Second),
+	}
+
+	// LocalConn and Host are set before pumping
+	switch atomic.LoadInt32(&p.state) {
+	case pairConnecting:
+		info.State = sessionConnecting
+		return info
+	case pairSuspending:
+		info.State = sessionSuspending
+	default:
+		if p.RemoteConn.Frozen() {
+			info.State = sessionWaiting
+		} else {
+			info.State = sessionActive
+		}
+	}
+	info.UpstreamAddr = p.LocalConn.RemoteAddr().String()
+	info.Host = p.Host.Name
+	return info
+}
+
+func (p *connPair) detail(now time.Time) *SessionDetail {
+	scon := p.RemoteConn.Current()
+	detail := &SessionDetail{
+		SessionInfo:     *p.info(now),
+		ClientLocalAddr: scon.LocalAddr().String(),
+		Flag:            scon.Flag(),
+	}
+	detail.ReuseBufferLen, detail.ReuseBufferSize = scon.ReuseBufferLen()
+	if sess := kcpSessionOf(scon.RawConn()); sess != nil {
+		detail.KCP = kcpSessionStats(sess)
+	}
+	if detail.State == sessionConnecting {
+		return detail
+	}
+	detail.UpstreamLocalAddr = p.LocalConn.LocalAddr().String()
+	detail.HostAddr = p.Host.Addr
+	if _, ok := p.LocalConn.(*LocalSCPConn); ok {
+		detail.UpstreamNet = "scp"
+	} else {
+		detail.UpstreamNet = "tcp"
+	}
+	return detail
+}
+
+// pairs returns all pairs sorted by id
+func (ss *SCPServer) pairs() []*connPair {
+	ss.connPairMutex.Lock()
+	pairs := make([]*connPair, 0, len(ss.connPairs))
+	for _, pair := range ss.connPairs {
+		pairs = append(pairs, pair)
+	}
+	ss.connPairMutex.Unlock()
+
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].RemoteConn.ID() < pairs[j].RemoteConn.ID()
+	})
+	return pairs
+}
+
+// sessionFilter selects sessions by query parameters
+type sessionFilter struct {
+	ip        string // ip of client
+	target    string // targetServer
+	upstream  string // name of host, or address of upstream
+	state     string
+	transport string
+}
+
+func newSessionFilter(r *http.Request) *sessionFilter {
+	return &sessionFilter{
+		ip:        r.FormValue("ip"),
+		target:    r.FormValue("target"),
+		upstream:  r.FormValue("upstream"),
+		state:     r.FormValue("state"),
+		transport: r.FormValue("transport"),
+	}
+}
+
+func (f *sessionFilter) match(info *SessionInfo) bool {
+	if f.ip != "" {
+		host, _, err := net.SplitHostPort(info.ClientAddr)
+		if err != nil || host != f.ip {
+			return false
+		}
+	}
+	if f.target != "" && info.TargetServer != f.target {
+		return false
+	}
+	if f.upstream != "" && info.Host != f.upstream && info.UpstreamAddr != f.upstream {
+		return false
+	}
+	if f.state != "" && info.State != f.state {
+		return false
+	}
+	if f.transport != "" && info.Transport != f.transport {
+		return false
+	}
+	return true
+}
+
+func formInt(r *http.Request, key string, def int) int {
+	v, err := strconv.Atoi(r.FormValue(key))
+	if err != nil || v < 0 {
+		return def
+	}
+	return v
+}
+
+// pageSessions returns the page of sessions matched by query parameters
+func pageSessions(r *http.Request, infos []*SessionInfo) *SessionList {
+	filter := newSessionFilter(r)
+	offset := formInt(r, "offset", 0)
+	limit := formInt(r, "limit", defaultSessionLimit)
+	if limit == 0 || limit > maxSessionLimit {
+		limit = maxSessionLimit
+	}
+
+	list := &SessionList{
+		Offset:   offset,
+		Limit:    limit,
+		Sessions: []*SessionInfo{},
+	}
+	for _, info := range infos {
+		if !filter.match(info) {
+			continue
+		}
+		if list.Total >= offset && len(list.Sessions) < limit {
+			list.Sessions = append(list.Sessions, info)
+		}
+		list.Total++
+	}
+	return list
+}
+
+func listSessions(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	pairs := defaultServer.pairs()
+	infos := make([]*SessionInfo, len(pairs))
+	for i, pair := range pairs {
+		infos[i] = pair.info(now)
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(pageSessions(r, infos))
+}
+
+func showSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/sessions/"))
+	if err != nil {
+		http.Error(w, "invalid session id", http.StatusBadRequest)
+		return
+	}
+	pair := defaultServer.getConnPair(id)
+	if pair == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(pair.detail(time.Now()))
+}
+
+// kickSessions closes sessions selected by id, ip or upstream
+func kickSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter := newSessionFilter(r)
+	id := -1
+	if s := r.FormValue("id"); s != "" {
+		var err error
+		if id, err = strconv.Atoi(s); err != nil {
+			io.WriteString(w, "failed: "+errInvalidParameter.Error())
+			return
+		}
+	}
+	// at least one selector is required, in case of closing all sessions
+	reason := r.FormValue("reason")
+	if (id < 0 && filter.ip == "" && filter.upstream == "") || strings.ContainsAny(reason, "\r\n") {
+		io.WriteString(w, "failed: "+errInvalidParameter.Error())
+		return
+	}
+
+	n := 0
+	now := time.Now()
+	for _, pair := range defaultServer.pairs() {
+		info := pair.info(now)
+		if (id >= 0 && info.ID != id) || !filter.match(info) {
+			continue
+		}
+		defaultServer.kick(pair, reason)
+		n++
+		glog.Infof("session kick: id=%d, client=%s, upstream=%s, reason=%s, caller=%s",
+			info.ID, info.ClientAddr, info.UpstreamAddr, reason, callerOf(r))
+	}
+	io.WriteString(w, fmt.Sprintf("succeed: kicked=%d", n))
+}
+
+func registerSessionHandlers() {
+	http.HandleFunc("/sessions", listSessions)
+	http.HandleFunc("/sessions/", showSession)
+	http.HandleFunc("/sessions/kick", kickSessions)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func testSessionInfos() []*SessionInfo {
+	infos := make([]*SessionInfo, 0, 250)
+	for i := 1; i <= 250; i++ {
+		info := &SessionInfo{
+			ID:           i,
+			Transport:    "tcp",
+			ClientAddr:   "10.0.0." + strconv.Itoa(i%4) + ":" + strconv.Itoa(10000+i),
+			UpstreamAddr: "127.0.0.1:" + strconv.Itoa(11000+i%2),
+			Host:         "game" + strconv.Itoa(i%2),
+			TargetServer: "game" + strconv.Itoa(i%2),
+			State:        sessionActive,
+		}
+		if i%5 == 0 {
+			info.Transport = "kcp"
+			info.State = sessionWaiting
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+func TestSessionFilter(t *testing.T) {
+	info := &SessionInfo{
+		Transport:    "kcp",
+		ClientAddr:   "10.0.0.1:10001",
+		UpstreamAddr: "127.0.0.1:11000",
+		Host:         "game1",
+		TargetServer: "game",
+		State:        sessionActive,
+	}
+	cases := []struct {
+		query string
+		match bool
+	}{
+		{"", true},
+		{"ip=10.0.0.1", true},
+		{"ip=10.0.0.2", false},
+		{"ip=10.0.0.1:10001", false},
+		{"target=game", true},
+		{"target=game1", false},
+		{"upstream=game1", true},
+		{"upstream=127.0.0.1:11000", true},
+		{"upstream=game2", false},
+		{"state=active", true},
+		{"state=waiting", false},
+		{"transport=kcp", true},
+		{"transport=tcp", false},
+		{"ip=10.0.0.1&upstream=game1&state=active", true},
+		{"ip=10.0.0.1&upstream=game1&state=waiting", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/sessions?"+c.query, nil)
+		if match := newSessionFilter(r).match(info); match != c.match {
+			t.Errorf("%q: match=%v", c.query, match)
+		}
+	}
+}
+
+func TestPageSessions(t *testing.T) {
+	infos := testSessionInfos()
+	cases := []struct {
+		query          string
+		total          int
+		offset, limit  int
+		first, entries int // id of first session, and sessions in page
+	}{
+		{"", 250, 0, defaultSessionLimit, 1, defaultSessionLimit},
+		{"offset=240", 250, 240, defaultSessionLimit, 241, 10},
+		{"offset=250", 250, 250, defaultSessionLimit, 0, 0},
+		{"offset=10&limit=5", 250, 10, 5, 11, 5},
+		// invalid or too large limit falls back
+		{"limit=0", 250, 0, maxSessionLimit, 1, 250},
+		{"limit=5000", 250, 0, maxSessionLimit, 1, 250},
+		{"offset=-1&limit=x", 250, 0, defaultSessionLimit, 1, defaultSessionLimit},
+		// paged after filtered
+		{"transport=kcp&limit=10", 50, 0, 10, 5, 10},
+		{"state=waiting&offset=45", 50, 45, defaultSessionLimit, 230, 5},
+		{"ip=10.0.0.1&upstream=game1", 63, 0, defaultSessionLimit, 1, 63},
+		{"target=game3", 0, 0, defaultSessionLimit, 0, 0},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/sessions?"+c.query, nil)
+		list := pageSessions(r, infos)
+		if list.Total != c.total || list.Offset != c.offset || list.Limit != c.limit || len(list.Sessions) != c.entries {
+			t.Errorf("%q: total=%d, offset=%d, limit=%d, sessions=%d", c.query, list.Total, list.Offset, list.Limit, len(list.Sessions))
+			continue
+		}
+		if c.entries > 0 && list.Sessions[0].ID != c.first {
+			t.Errorf("%q: first=%d, want %d", c.query, list.Sessions[0].ID, c.first)
+		}
+	}
+}
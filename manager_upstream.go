@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ejoy/goscon/upstream"
+	"github.com/spf13/viper"
+	"github.com/xjdrew/glog"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	errHostNotFound     = errors.New("host not found")
+	errHostExists       = errors.New("host exists")
+	errInvalidParameter = errors.New("invalid parameter")
+	errUnsupportedFile  = errors.New("unsupported config file type")
+	errZeroWeight       = errors.New("weight must be positive, drain host to stop new sessions")
+)
+
+// matchHost reports whether h is addressed by name and addr, addr may be Addr or SRV of h
+func matchHost(h *upstream.Host, name, addr string) bool {
+	return h.Name == name && (h.Addr == addr || (h.SRV != "" && h.SRV == addr))
+}
+
+func hostToYAML(h upstream.Host) yaml.MapSlice {
+	m := yaml.MapSlice{{Key: "name", Value: h.Name}}
+	if h.SRV != "" {
+		m = append(m, yaml.MapItem{Key: "srv", Value: h.SRV})
+	} else {
+		m = append(m, yaml.MapItem{Key: "addr", Value: h.Addr})
+	}
+	if h.Weight > 0 {
+		m = append(m, yaml.MapItem{Key: "weight", Value: h.Weight})
+	}
+	if h.Drain {
+		m = append(m, yaml.MapItem{Key: "drain", Value: h.Drain})
+	}
+	return m
+}
+
+func hostToJSON(h upstream.Host) map[string]interface{} {
+	m := make(map[string]interface{})
+	for _, item := range hostToYAML(h) {
+		m[item.Key.(string)] = item.Value
+	}
+	return m
+}
+
+// writeFileAtomic writes data to a temporary file, then renames it to filename
+func writeFileAtomic(filename string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// replaceYAMLSection replaces top level key of yaml data by section, or appends section if key isn't found.
+// Other lines, including comments, are kept as they are.
+func replaceYAMLSection(data []byte, key string, section []byte) []byte {
+	lines := strings.SplitAfter(string(data), "\n")
+	start := -1
+	for i, line := range lines {
+		if strings.HasPrefix(line, key+":") {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		var b strings.Builder
+		b.Write(data)
+		if len(data) > 0 && !strings.HasSuffix(string(data), "\n") {
+			b.WriteString("\n")
+		}
+		b.Write(section)
+		return []byte(b.String())
+	}
+
+	// section ends before the next line at column 0, except items of a sequence
+	end := start + 1
+	last := start + 1 // end of the last line of section, trailing blank lines are kept
+	for ; end < len(lines); end++ {
+		line := lines[end]
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' && line[0] != '-' {
+			break
+		}
+		last = end + 1
+	}
+
+	var b strings.Builder
+	for _, line := range lines[:start] {
+		b.WriteString(line)
+	}
+	b.Write(section)
+	for _, line := range lines[last:] {
+		b.WriteString(line)
+	}
+	return []byte(b.String())
+}
+
+// persistHosts writes hosts back to hosts file if used, otherwise to hosts section of config file.
+// Comments in hosts section of the config file are not preserved.
+// Revision of hosts file is dropped, so digest of content is used as revision.
+func persistHosts(hosts []upstream.Host) error {
+	filename := viper.GetString("hosts_file")
+	isHostsFile := filename != ""
+	if !isHostsFile {
+		filename = viper.ConfigFileUsed()
+	}
+
+	if strings.HasSuffix(filename, ".json") {
+		if !isHostsFile {
+			return errUnsupportedFile
+		}
+		list := make([]map[string]interface{}, len(hosts))
+		for i, h := range hosts {
+			list[i] = hostToJSON(h)
+		}
+		data, err := json.MarshalIndent(map[string]interface{}{
+			"hosts": list,
+		}, "", "  ")
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(filename, data)
+	}
+
+	ext := filepath.Ext(filename)
+	if ext != ".yaml" && ext != ".yml" {
+		return errUnsupportedFile
+	}
+
+	list := make([]yaml.MapSlice, len(hosts))
+	for i, h := range hosts {
+		list[i] = hostToYAML(h)
+	}
+
+	if isHostsFile {
+		data, err := yaml.Marshal(yaml.MapSlice{
+			{Key: "hosts", Value: list},
+		})
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(filename, data)
+	}
+
+	section, err := yaml.Marshal(yaml.MapSlice{{Key: "hosts", Value: list}})
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	data = replaceYAMLSection(data, "hosts", section)
+
+	// never write a config file which can't be loaded
+	var content yaml.MapSlice
+	if err = yaml.Unmarshal(data, &content); err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, data)
+}
+
+// modifyHosts applies modify to hosts, and updates upstream with the result.
+// Hosts are persisted before updating upstream, so nothing is changed if persisting fails.
+func modifyHosts(r *http.Request, modify func(hosts []upstream.Host) ([]upstream.Host, error)) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	old := upstream.Hosts()
+	hosts, err := modify(upstream.Hosts())
+	if err != nil {
+		return err
+	}
+
+	persist, _ := strconv.ParseBool(r.FormValue("persist"))
+	if persist {
+		if err = persistHosts(hosts); err != nil {
+			glog.Errorf("persist hosts failed: err=%s", err.Error())
+			return err
+		}
+	}
+	if err = upstream.SetHosts(hosts); err != nil {
+		if persist {
+			// write back hosts in use
+			if perr := persistHosts(old); perr != nil {
+				glog.Errorf("restore persisted hosts failed: err=%s", perr.Error())
+			}
+		}
+		return err
+	}
+	glog.Infof("upstream hosts modified: path=%s, query=%s, persist=%v, caller=%s", r.URL.Path, r.Form.Encode(), persist, callerOf(r))
+	return nil
+}
+
+func handleModifyHosts(modify func(r *http.Request, hosts []upstream.Host) ([]upstream.Host, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		err := modifyHosts(r, func(hosts []upstream.Host) ([]upstream.Host, error) {
+			return modify(r, hosts)
+		})
+		if err == nil {
+			io.WriteString(w, "succeed")
+		} else {
+			io.WriteString(w, "failed: "+err.Error())
+		}
+	}
+}
+
+func findHost(hosts []upstream.Host, name, addr string) int {
+	for i := range hosts {
+		if matchHost(&hosts[i], name, addr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// formWeight returns weight in form, 0 if it's absent and not required.
+// Weight 0 means default weight in hosts, so it's refused here.
+func formWeight(r *http.Request, required bool) (int, error) {
+	s := r.FormValue("weight")
+	if s == "" {
+		if required {
+			return 0, errInvalidParameter
+		}
+		return 0, nil
+	}
+	weight, err := strconv.Atoi(s)
+	if err != nil || weight < 0 {
+		return 0, errInvalidParameter
+	}
+	if weight == 0 {
+		return 0, errZeroWeight
+	}
+	return weight, nil
+}
+
+func addHost(r *http.Request, hosts []upstream.Host) ([]upstream.Host, error) {
+	name := r.FormValue("name")
+	addr := r.FormValue("addr")
+	srv := r.FormValue("srv")
+	if (addr == "") == (srv == "") {
+		return nil, errInvalidParameter
+	}
+	key := addr
+	if srv != "" {
+		key = srv
+	}
+	if findHost(hosts, name, key) >= 0 {
+		return nil, errHostExists
+	}
+	weight, err := formWeight(r, false)
+	if err != nil {
+		return nil, err
+	}
+	return append(hosts, upstream.Host{
+		Name:   name,
+		Addr:   addr,
+		SRV:    srv,
+		Weight: weight,
+	}), nil
+}
+
+func removeHost(r *http.Request, hosts []upstream.Host) ([]upstream.Host, error) {
+	i := findHost(hosts, r.FormValue("name"), r.FormValue("addr"))
+	if i < 0 {
+		return nil, errHostNotFound
+	}
+	return append(hosts[:i], hosts[i+1:]...), nil
+}
+
+func setHostWeight(r *http.Request, hosts []upstream.Host) ([]upstream.Host, error) {
+	i := findHost(hosts, r.FormValue("name"), r.FormValue("addr"))
+	if i < 0 {
+		return nil, errHostNotFound
+	}
+	weight, err := formWeight(r, true)
+	if err != nil {
+		return nil, err
+	}
+	hosts[i].Weight = weight
+	return hosts, nil
+}
+
+func drainHost(r *http.Request, hosts []upstream.Host) ([]upstream.Host, error) {
+	i := findHost(hosts, r.FormValue("name"), r.FormValue("addr"))
+	if i < 0 {
+		return nil, errHostNotFound
+	}
+	drain := true
+	if s := r.FormValue("drain"); s != "" {
+		var err error
+		if drain, err = strconv.ParseBool(s); err != nil {
+			return nil, errInvalidParameter
+		}
+	}
+	hosts[i].Drain = drain
+	return hosts, nil
+}
+
+func registerUpstreamHandlers() {
+	http.HandleFunc("/upstream/hosts", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.Encode(upstream.HostStatuses())
+	})
+	http.HandleFunc("/upstream/ejections", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.Encode(upstream.Ejections())
+	})
+	http.HandleFunc("/upstream/discovery", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.Encode(defaultHostsFile.Status())
+	})
+	http.HandleFunc("/upstream/hosts/add", handleModifyHosts(addHost))
+	http.HandleFunc("/upstream/hosts/remove", handleModifyHosts(removeHost))
+	http.HandleFunc("/upstream/hosts/weight", handleModifyHosts(setHostWeight))
+	http.HandleFunc("/upstream/hosts/drain", handleModifyHosts(drainHost))
+}
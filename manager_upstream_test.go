@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ejoy/goscon/upstream"
+	"github.com/spf13/viper"
+)
+
+func TestReplaceYAMLSection(t *testing.T) {
+	section := "hosts:\n- name: s1\n  addr: 127.0.0.1:1\n"
+	cases := []struct {
+		data string
+		want string
+	}{
+		{
+			"tcp: 0.0.0.0:1248 # listen\nhosts:\n  - name: s0\n    addr: 127.0.0.1:0 # old\n\n# upstream\nupstream_option:\n  net: tcp\n",
+			"tcp: 0.0.0.0:1248 # listen\n" + section + "\n# upstream\nupstream_option:\n  net: tcp\n",
+		},
+		{
+			"hosts:\n- name: s0\n  addr: 127.0.0.1:0\nscp:\n  reuse_time: 30\n",
+			section + "scp:\n  reuse_time: 30\n",
+		},
+		{
+			"hosts: []\nhosts_file: \"\"\n",
+			section + "hosts_file: \"\"\n",
+		},
+		{
+			"tcp: 0.0.0.0:1248\nhosts:\n  - name: s0\n    addr: 127.0.0.1:0",
+			"tcp: 0.0.0.0:1248\n" + section,
+		},
+		{
+			"# no hosts\nhosts_file: hosts.yaml",
+			"# no hosts\nhosts_file: hosts.yaml\n" + section,
+		},
+	}
+	for i, c := range cases {
+		if got := string(replaceYAMLSection([]byte(c.data), "hosts", []byte(section))); got != c.want {
+			t.Errorf("case %d:\n%s\nwant:\n%s", i, got, c.want)
+		}
+	}
+}
+
+func TestFormWeight(t *testing.T) {
+	cases := []struct {
+		query    string
+		required bool
+		weight   int
+		err      error
+	}{
+		{"", false, 0, nil},
+		{"", true, 0, errInvalidParameter},
+		{"weight=50", true, 50, nil},
+		{"weight=0", false, 0, errZeroWeight},
+		{"weight=0", true, 0, errZeroWeight},
+		{"weight=-1", false, 0, errInvalidParameter},
+		{"weight=x", false, 0, errInvalidParameter},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/upstream/hosts/weight?"+c.query, nil)
+		weight, err := formWeight(r, c.required)
+		if weight != c.weight || err != c.err {
+			t.Errorf("%q required=%v: got %d %v, want %d %v", c.query, c.required, weight, err, c.weight, c.err)
+		}
+	}
+}
+
+func TestModifyHostsPersistFailed(t *testing.T) {
+	viper.Set("hosts_file", "hosts.txt")
+	defer viper.Set("hosts_file", "")
+
+	before := upstream.Hosts()
+	r := httptest.NewRequest(http.MethodPost, "/upstream/hosts/add?name=s1&addr=127.0.0.1:1&persist=true", nil)
+	err := modifyHosts(r, func(hosts []upstream.Host) ([]upstream.Host, error) {
+		return addHost(r, hosts)
+	})
+	if err != errUnsupportedFile {
+		t.Fatalf("got %v, want %v", err, errUnsupportedFile)
+	}
+	if after := upstream.Hosts(); len(after) != len(before) {
+		t.Fatalf("hosts applied without persisting: %v", after)
+	}
+}
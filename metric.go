@@ -3,9 +3,11 @@ package main
 import (
 	"errors"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/ejoy/goscon/scp"
+	"github.com/ejoy/goscon/upstream"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -20,6 +22,16 @@ var (
 		Help: "failed times of accept connection from client",
 	})
 
+	connectionRejects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goscon_connection_rejects",
+		Help: "number of rejected connections, partitioned by reason",
+	}, []string{"reason"})
+
+	ipBans = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "goscon_ip_bans",
+		Help: "times of ip banned for handshake failures",
+	})
+
 	connectionCloses = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "goscon_connection_close",
 		Help: "times of close connection from client",
@@ -48,6 +60,68 @@ var (
 		Help: "times of reuse failed",
 	})
 
+	connectionReuseLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "goscon_connection_reuse_latency_seconds",
+		Help:    "seconds from client conn broken to reused, partitioned by transport of new conn and whether transport is switched",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"transport", "switched"})
+
+	connectionReuseTimeoutWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "goscon_connection_reuse_timeout_wait_seconds",
+		Help:    "seconds from client conn broken to reuse timeout, partitioned by transport",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"transport"})
+
+	connectionCloseReasons = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goscon_connection_close_reasons",
+		Help: "number of closed sessions, partitioned by reason",
+	}, []string{"reason"})
+
+	connectionBreaks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goscon_connection_breaks",
+		Help: "number of broken scp conns waiting for reuse, partitioned by reason",
+	}, []string{"reason"})
+
+	connectionKicks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "goscon_connection_kicks",
+		Help: "times of connection closed by manager",
+	})
+
+	sessions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "goscon_sessions",
+		Help: "number of live sessions, including those waiting for reuse, partitioned by listener and target server",
+	}, []string{"listener", "target"})
+
+	sessionsWaiting = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "goscon_sessions_waiting",
+		Help: "number of sessions waiting for client to reuse, partitioned by listener and target server",
+	}, []string{"listener", "target"})
+
+	handshakesInProgress = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "goscon_handshakes_in_progress",
+		Help: "number of handshakes in progress, partitioned by listener",
+	}, []string{"listener"})
+
+	upstreamConns = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "goscon_upstream_conns",
+		Help: "number of connections to upstream, partitioned by listener, target server and host name",
+	}, []string{"listener", "target", "host"})
+
+	trafficBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goscon_traffic_bytes",
+		Help: "bytes transferred, partitioned by direction, upstream host and target server",
+	}, []string{"direction", "host", "target"})
+
+	trafficPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goscon_traffic_packets",
+		Help: "packets transferred, partitioned by direction, upstream host and target server",
+	}, []string{"direction", "host", "target"})
+
+	throttledSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goscon_throttled_seconds",
+		Help: "seconds of sessions delayed by throttle, partitioned by direction",
+	}, []string{"direction"})
+
 	upstreamErrors = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "goscon_upstream_fails",
 		Help: "times of failed to connect to upstream",
@@ -57,12 +131,66 @@ var (
 func init() {
 	prometheus.MustRegister(connectionAccepts)
 	prometheus.MustRegister(connectionAcceptFails)
+	prometheus.MustRegister(connectionRejects)
+	prometheus.MustRegister(ipBans)
 	prometheus.MustRegister(connectionCloses)
 	prometheus.MustRegister(handshakeErrors)
 	prometheus.MustRegister(connectionReuses)
 	prometheus.MustRegister(connectionResend)
 	prometheus.MustRegister(connectionReuseFails)
+	prometheus.MustRegister(connectionReuseLatency)
+	prometheus.MustRegister(connectionReuseTimeoutWait)
+	prometheus.MustRegister(connectionCloseReasons)
+	prometheus.MustRegister(connectionBreaks)
+	prometheus.MustRegister(connectionKicks)
+	prometheus.MustRegister(sessions)
+	prometheus.MustRegister(sessionsWaiting)
+	prometheus.MustRegister(handshakesInProgress)
+	prometheus.MustRegister(upstreamConns)
+	prometheus.MustRegister(trafficBytes)
+	prometheus.MustRegister(trafficPackets)
+	prometheus.MustRegister(throttledSeconds)
 	prometheus.MustRegister(upstreamErrors)
+	prometheus.MustRegister(newKCPCollector())
+}
+
+// label of targets exceed metric_max_targets
+const otherTargetLabel = "_other"
+
+var targetLabels struct {
+	sync.Mutex
+	seen map[string]struct{}
+}
+
+// targetLabel limits cardinality of label target, as targetServer is sent by client
+func targetLabel(target string) string {
+	if target == "" {
+		return target
+	}
+	targetLabels.Lock()
+	defer targetLabels.Unlock()
+	if _, ok := targetLabels.seen[target]; ok {
+		return target
+	}
+	if len(targetLabels.seen) >= configItemInt("metric_max_targets") {
+		return otherTargetLabel
+	}
+	if targetLabels.seen == nil {
+		targetLabels.seen = make(map[string]struct{})
+	}
+	targetLabels.seen[target] = struct{}{}
+	return target
+}
+
+// label of hosts not in the host list, whose names come from targetServer
+const temporaryHostLabel = "_temporary"
+
+// hostLabel limits cardinality of label host, as temporary hosts are named by targetServer
+func hostLabel(h *upstream.Host) string {
+	if h.Temporary() {
+		return temporaryHostLabel
+	}
+	return h.Name
 }
 
 func metricOnHandshakeError(err error) {
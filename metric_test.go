@@ -0,0 +1,14 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ejoy/goscon/upstream"
+)
+
+func TestHostLabel(t *testing.T) {
+	// hosts not in the host list are named by targetServer
+	if l := hostLabel(&upstream.Host{Name: "game-1", Addr: "127.0.0.1:10001"}); l != temporaryHostLabel {
+		t.Errorf("label of temporary host: %s", l)
+	}
+}
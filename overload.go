@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ejoy/goscon/scp"
+	"github.com/xjdrew/glog"
+)
+
+// reasons of overload, also reasons of rejecting conn
+const (
+	overloadGoroutines = "overload_goroutines"
+	overloadHeap       = "overload_heap"
+	overloadHandshakes = "overload_handshakes"
+)
+
+// pendingHandshakes is count of handshakes in progress, same as goscon_handshakes_in_progress
+var pendingHandshakes int64
+
+// overloadGuard sheds new sessions when process is overloaded, reused conns are always served.
+// Goroutines and heap are sampled at most once per overload.check_interval, as ReadMemStats stops the world.
+type overloadGuard struct {
+	mu         sync.Mutex
+	lastCheck  time.Time
+	goroutines int
+	heapInuse  uint64
+	reason     string // reason of current overload, empty if not overloaded
+}
+
+var defaultOverloadGuard = &overloadGuard{}
+
+func (g *overloadGuard) sample(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if now.Sub(g.lastCheck) < configItemTime("overload.check_interval") {
+		return
+	}
+	g.lastCheck = now
+	g.goroutines = runtime.NumGoroutine()
+	if configItemInt("overload.max_heap") > 0 {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		g.heapInuse = m.HeapInuse
+	}
+}
+
+// check returns reason if process is overloaded
+func (g *overloadGuard) check() string {
+	maxGoroutines := configItemInt("overload.max_goroutines")
+	maxHeap := configItemInt("overload.max_heap")
+	maxHandshakes := configItemInt("overload.max_handshakes")
+	if maxGoroutines <= 0 && maxHeap <= 0 && maxHandshakes <= 0 {
+		return ""
+	}
+
+	g.sample(time.Now())
+
+	var reason string
+	g.mu.Lock()
+	switch {
+	case maxGoroutines > 0 && g.goroutines >= maxGoroutines:
+		reason = overloadGoroutines
+	case maxHeap > 0 && g.heapInuse >= uint64(maxHeap)<<20:
+		reason = overloadHeap
+	case maxHandshakes > 0 && atomic.LoadInt64(&pendingHandshakes) > int64(maxHandshakes):
+		reason = overloadHandshakes
+	}
+	if reason != g.reason {
+		if reason != "" {
+			glog.Errorf("overload enter: reason=%s, goroutines=%d, heap_inuse=%d, handshakes=%d",
+				reason, g.goroutines, g.heapInuse, atomic.LoadInt64(&pendingHandshakes))
+		} else {
+			glog.Infof("overload leave: reason=%s", g.reason)
+		}
+		g.reason = reason
+	}
+	g.mu.Unlock()
+	return reason
+}
+
+// overloadError tells client to retry after overload.retry_after seconds, with jitter to spread retries
+func overloadError() *scp.Error {
+	retryAfter := configItemInt("overload.retry_after")
+	if retryAfter > 0 {
+		retryAfter += rand.Intn(retryAfter)
+	}
+	return &scp.Error{
+		Code: scp.SCPStatusServiceUnavailable,
+		Desc: fmt.Sprintf("Service Unavailable retry_after=%d", retryAfter),
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ejoy/goscon/scp"
+)
+
+func TestOverloadCheck(t *testing.T) {
+	cases := []struct {
+		maxGoroutines, maxHeap, maxHandshakes int
+		goroutines                            int
+		heapInuse                             uint64
+		handshakes                            int64
+		reason                                string
+	}{
+		{0, 0, 0, 100000, 1 << 40, 100000, ""},
+		{100, 0, 0, 99, 0, 0, ""},
+		{100, 0, 0, 100, 0, 0, overloadGoroutines},
+		{0, 64, 0, 0, 63 << 20, 0, ""},
+		{0, 64, 0, 0, 64 << 20, 0, overloadHeap},
+		{0, 0, 10, 0, 0, 10, ""},
+		{0, 0, 10, 0, 0, 11, overloadHandshakes},
+		// goroutines are checked first
+		{100, 64, 10, 100, 64 << 20, 11, overloadGoroutines},
+		{100, 64, 10, 0, 64 << 20, 11, overloadHeap},
+	}
+	defer atomic.StoreInt64(&pendingHandshakes, 0)
+	for i, c := range cases {
+		restore := setConfigItems(map[string]interface{}{
+			"overload.max_goroutines": c.maxGoroutines,
+			"overload.max_heap":       c.maxHeap,
+			"overload.max_handshakes": c.maxHandshakes,
+			"overload.check_interval": 3600,
+		})
+		// sampled just now, so samples are kept
+		g := &overloadGuard{lastCheck: time.Now(), goroutines: c.goroutines, heapInuse: c.heapInuse}
+		atomic.StoreInt64(&pendingHandshakes, c.handshakes)
+		if reason := g.check(); reason != c.reason {
+			t.Errorf("case %d: reason=%q, want %q", i, reason, c.reason)
+		}
+		restore()
+	}
+}
+
+func TestOverloadSample(t *testing.T) {
+	defer setConfigItems(map[string]interface{}{
+		"overload.max_heap":       1,
+		"overload.check_interval": 10,
+	})()
+
+	now := time.Now()
+	g := &overloadGuard{}
+	g.sample(now)
+	if g.goroutines == 0 || g.heapInuse == 0 {
+		t.Fatalf("not sampled: goroutines=%d, heap_inuse=%d", g.goroutines, g.heapInuse)
+	}
+	// sampled at most once per interval
+	g.goroutines = 0
+	g.sample(now.Add(5 * time.Second))
+	if g.goroutines != 0 {
+		t.Errorf("sampled within interval")
+	}
+	g.sample(now.Add(10 * time.Second))
+	if g.goroutines == 0 {
+		t.Errorf("not sampled after interval")
+	}
+}
+
+func TestOverloadError(t *testing.T) {
+	cases := []struct {
+		retryAfter int
+		min, max   int
+	}{
+		{0, 0, 0},
+		{5, 5, 9},
+	}
+	for _, c := range cases {
+		restore := setConfigItems(map[string]interface{}{"overload.retry_after": c.retryAfter})
+		for i := 0; i < 20; i++ {
+			serr := overloadError()
+			var retryAfter int
+			if _, err := fmt.Sscanf(serr.Desc, "Service Unavailable retry_after=%d", &retryAfter); err != nil {
+				t.Fatalf("desc: %s", serr.Desc)
+			}
+			if serr.Code != scp.SCPStatusServiceUnavailable || retryAfter < c.min || retryAfter > c.max {
+				t.Errorf("retry_after=%d: %d %s", c.retryAfter, serr.Code, serr.Desc)
+			}
+		}
+		restore()
+	}
+}
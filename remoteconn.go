@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"strconv"
 	"sync"
 	"time"
 
@@ -9,6 +10,7 @@ import (
 )
 
 var errConnClosed = errors.New("conn closed")
+var errConnSuspended = errors.New("conn suspended")
 
 // SCPConn .
 type SCPConn struct {
@@ -18,27 +20,59 @@ type SCPConn struct {
 	connCond   *sync.Cond
 	connErr    error // error when operate on conn
 	connClosed bool  // conn closed
+	suspended  bool  // conn is suspended for handoff
+
+	side        string    // sideClient or sideUpstream
+	listener    string    // transport of the first conn, for metric
+	target      string    // targetServer of the first conn, for metric
+	breakReason string    // reason of the last broken conn
+	brokenAt    time.Time // when conn is broken, zero if unknown
+	closeReason string    // reason of close, set if closed by reuse timeout
 
 	// for reuse timeout
 	reuseCh      chan struct{}
 	reuseTimeout time.Duration
 }
 
-func (s *SCPConn) setConnError(conn *scp.Conn, err error) {
+// setConnError reports whether err is set
+func (s *SCPConn) setConnError(conn *scp.Conn, err error) bool {
 	if err == nil {
-		return
+		return false
 	}
 
 	s.connMutex.Lock()
 	defer s.connMutex.Unlock()
 	if conn != s.Conn {
-		return
+		return false
 	}
 
-	if s.connClosed {
-		return
+	if s.connClosed || s.connErr != nil {
+		return false
 	}
 	s.connErr = err
+	s.updateWaiting(1)
+	return true
+}
+
+// updateWaiting updates gauge of client conns waiting for reuse
+func (s *SCPConn) updateWaiting(delta float64) {
+	if s.side == sideClient {
+		sessionsWaiting.WithLabelValues(s.listener, s.target).Add(delta)
+	}
+}
+
+// breakConn freezes conn on err, waiting for reuse
+func (s *SCPConn) breakConn(conn *scp.Conn, err error) {
+	conn.Freeze()
+	if !s.setConnError(conn, err) {
+		return
+	}
+	reason := classifyErr(s.side, err)
+	s.connMutex.Lock()
+	s.breakReason = reason
+	s.brokenAt = time.Now()
+	s.connMutex.Unlock()
+	connectionBreaks.WithLabelValues(reason).Inc()
 }
 
 // startWait 启动超时计数
@@ -51,7 +85,8 @@ func (s *SCPConn) startWait() {
 	go func() {
 		select {
 		case <-time.After(s.reuseTimeout):
-			s.Close()
+			s.closeWithReason(s.side + "_" + reasonReuseTimeout)
+			s.observeReuseTimeout()
 		case <-done:
 		}
 	}()
@@ -73,6 +108,8 @@ func (s *SCPConn) acquireConn() (*scp.Conn, error) {
 	for {
 		if s.connClosed {
 			return nil, s.connErr
+		} else if s.suspended {
+			return nil, errConnSuspended
 		} else if s.connErr != nil {
 			s.startWait()
 			s.connCond.Wait()
@@ -91,10 +128,13 @@ func (s *SCPConn) Read(p []byte) (int, error) {
 	}
 
 	n, err := conn.Read(p)
+	if err != nil && s.isSuspended() {
+		// keep conn for handoff
+		return n, errConnSuspended
+	}
 	if err != nil {
 		// freeze, waiting for reuse
-		conn.Freeze()
-		s.setConnError(conn, err)
+		s.breakConn(conn, err)
 	}
 	return n, nil
 }
@@ -104,15 +144,14 @@ func (s *SCPConn) Write(p []byte) (int, error) {
 	var nn int
 	for {
 		conn, err := s.acquireConn()
-		if err != nil { // conn is closed
-			return 0, err
+		if err != nil { // conn is closed or suspended
+			return nn, err
 		}
 		n, err := conn.Write(p[nn:])
 
 		if err != nil {
 			// freeze, waiting for reuse
-			conn.Freeze()
-			s.setConnError(conn, err)
+			s.breakConn(conn, err)
 		}
 		nn = nn + n
 		if nn == len(p) {
@@ -126,7 +165,7 @@ func (s *SCPConn) Write(p []byte) (int, error) {
 func (s *SCPConn) ReplaceConn(conn *scp.Conn) bool {
 	s.connMutex.Lock()
 	defer s.connMutex.Unlock()
-	if s.connClosed {
+	if s.connClosed || s.suspended {
 		return false
 	}
 
@@ -135,21 +174,101 @@ func (s *SCPConn) ReplaceConn(conn *scp.Conn) bool {
 	// close old conn
 	s.Conn.Close()
 
+	// outage is known only if server noticed that old conn is broken
+	if s.side == sideClient && s.connErr != nil && !s.brokenAt.IsZero() {
+		from, to := transportOf(s.Conn.RawConn()), transportOf(conn.RawConn())
+		connectionReuseLatency.WithLabelValues(to, strconv.FormatBool(from != to)).Observe(time.Since(s.brokenAt).Seconds())
+	}
+
 	// set new status
+	if s.connErr != nil {
+		s.updateWaiting(-1)
+	}
 	s.Conn = conn
 	s.connErr = nil
+	s.brokenAt = time.Time{}
 	s.connCond.Broadcast()
 	return true
 }
 
+// observeReuseTimeout records how long client waited before reuse timeout
+func (s *SCPConn) observeReuseTimeout() {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	if s.side == sideClient && !s.brokenAt.IsZero() {
+		connectionReuseTimeoutWait.WithLabelValues(transportOf(s.Conn.RawConn())).Observe(time.Since(s.brokenAt).Seconds())
+	}
+}
+
+func (s *SCPConn) isSuspended() bool {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	return s.suspended
+}
+
+// Suspend interrupts Read and Write for handoff, later calls return errConnSuspended.
+// Blocking write is interrupted only if force is set, the conn is frozen then.
+func (s *SCPConn) Suspend(force bool) {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	if s.connClosed {
+		return
+	}
+	s.suspended = true
+	if s.connErr == nil {
+		if force {
+			s.Conn.SetDeadline(time.Now())
+		} else {
+			s.Conn.SetReadDeadline(time.Now())
+		}
+	}
+	s.connCond.Broadcast()
+}
+
+// Current returns current scp.Conn
+func (s *SCPConn) Current() *scp.Conn {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	return s.Conn
+}
+
+// Frozen reports whether conn is waiting for reuse
+func (s *SCPConn) Frozen() bool {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	return s.connErr != nil
+}
+
+// BreakReason returns reason of the last broken conn, empty if never broken
+func (s *SCPConn) BreakReason() string {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	return s.breakReason
+}
+
+// CloseReason returns reason of close, empty if it's closed by Close
+func (s *SCPConn) CloseReason() string {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	return s.closeReason
+}
+
 // Close .
 func (s *SCPConn) Close() error {
+	return s.closeWithReason("")
+}
+
+func (s *SCPConn) closeWithReason(reason string) error {
 	s.connMutex.Lock()
 	defer s.connMutex.Unlock()
 	if s.connClosed {
 		return s.connErr
 	}
 
+	if s.connErr != nil {
+		s.updateWaiting(-1)
+	}
+	s.closeReason = reason
 	s.connClosed = true
 	s.connErr = errConnClosed
 	err := s.Conn.Close()
@@ -159,7 +278,12 @@ func (s *SCPConn) Close() error {
 
 // NewSCPConn .
 func NewSCPConn(scon *scp.Conn) *SCPConn {
-	scpConn := &SCPConn{Conn: scon}
+	scpConn := &SCPConn{
+		Conn:     scon,
+		side:     sideClient,
+		listener: transportOf(scon.RawConn()),
+		target:   targetLabel(scon.TargetServer()),
+	}
 	scpConn.connCond = sync.NewCond(&scpConn.connMutex)
 	scpConn.reuseTimeout = configItemTime("scp.reuse_time")
 	return scpConn
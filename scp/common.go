@@ -14,13 +14,17 @@ var HandshakeTimeout time.Duration // 0s
 
 // SCPStatus Code
 const (
-	SCPStatusOK            = 200 // succeed
-	SCPStatusBadRequest    = 400 // malformed request
-	SCPStatusUnauthorized  = 401 // verify checksum failed
-	SCPStatusExpired       = 403 // verify handshake number failed
-	SCPStatusIDNotFound    = 404 // match old connection failed
-	SCPStatusNotAcceptable = 406 // reuse buffer overflow
-	SCPStatusNetworkError  = 501 //
+	SCPStatusOK                 = 200 // succeed
+	SCPStatusBadRequest         = 400 // malformed request
+	SCPStatusUnauthorized       = 401 // verify checksum failed
+	SCPStatusExpired            = 403 // verify handshake number failed
+	SCPStatusIDNotFound         = 404 // match old connection failed
+	SCPStatusNotAcceptable      = 406 // reuse buffer overflow
+	SCPStatusGone               = 410 // conn is closed by server, don't reuse
+	SCPStatusMaintenance        = 423 // refuse new connection for maintenance
+	SCPStatusTooManyRequests    = 429 // refuse new connection for limits
+	SCPStatusNetworkError       = 501 //
+	SCPStatusServiceUnavailable = 503 // refuse new connection
 )
 
 // Error .
@@ -49,6 +53,18 @@ var ErrIDNotFound = &Error{404, "ID Not Found"}
 // ErrNotAcceptable .
 var ErrNotAcceptable = &Error{406, "Not Acceptable"}
 
+// ErrGone .
+var ErrGone = &Error{410, "Gone"}
+
+// ErrMaintenance .
+var ErrMaintenance = &Error{423, "Maintenance"}
+
+// ErrTooManyRequests .
+var ErrTooManyRequests = &Error{429, "Too Many Requests"}
+
+// ErrServiceUnavailable .
+var ErrServiceUnavailable = &Error{503, "Service Unavailable"}
+
 func newError(code int) error {
 	switch code {
 	case SCPStatusOK:
@@ -61,6 +77,14 @@ func newError(code int) error {
 		return ErrIDNotFound
 	case SCPStatusNotAcceptable:
 		return ErrNotAcceptable
+	case SCPStatusGone:
+		return ErrGone
+	case SCPStatusMaintenance:
+		return ErrMaintenance
+	case SCPStatusTooManyRequests:
+		return ErrTooManyRequests
+	case SCPStatusServiceUnavailable:
+		return ErrServiceUnavailable
 	default:
 		return fmt.Errorf("%d Unknown", code)
 	}
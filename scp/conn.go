@@ -2,7 +2,6 @@ package scp
 
 import (
 	"bufio"
-	"crypto/rc4"
 	"encoding/binary"
 	"io"
 	"net"
@@ -18,14 +17,14 @@ var zeroTime time.Time
 type cipherConnReader struct {
 	sync.Mutex
 	rd     io.Reader
-	cipher *rc4.Cipher
+	cipher *rc4Cipher
 	count  int // bytes read
 }
 
 type cipherConnWriter struct {
 	sync.Mutex
 	wr     io.Writer
-	cipher *rc4.Cipher
+	cipher *rc4Cipher
 	count  int // bytes writed
 }
 
@@ -105,7 +104,7 @@ func newCipherConnReader(secret leu64) *cipherConnReader {
 	genRC4Key(secret, toLeu64(2), key[16:24])
 	genRC4Key(secret, toLeu64(3), key[24:32])
 
-	c, _ := rc4.NewCipher(key)
+	c := newRC4Cipher(key)
 	return &cipherConnReader{
 		cipher: c,
 	}
@@ -121,7 +120,7 @@ func newCipherConnWriter(secret leu64) *cipherConnWriter {
 	genRC4Key(secret, toLeu64(2), key[16:24])
 	genRC4Key(secret, toLeu64(3), key[24:32])
 
-	c, _ := rc4.NewCipher(key)
+	c := newRC4Cipher(key)
 	return &cipherConnWriter{
 		cipher: c,
 	}
@@ -254,6 +253,9 @@ func (c *Conn) clientReuseHandshake() error {
 		return err
 	}
 
+	if rp.code != SCPStatusOK && rp.msg != "" {
+		return &Error{rp.code, rp.msg}
+	}
 	if err := newError(rp.code); err != nil {
 		return err
 	}
@@ -292,6 +294,7 @@ func (c *Conn) clientNewHandshake() error {
 		key:          toLeu64(pubKey),
 		targetServer: c.config.TargetServer,
 		flag:         c.config.Flag,
+		hashKey:      c.config.HashKey,
 	}
 
 	if err := c.writeRecord(nq); err != nil {
@@ -304,7 +307,10 @@ func (c *Conn) clientNewHandshake() error {
 	}
 
 	if np.id == 0 {
-		panic("np.id == 0")
+		if np.code == SCPStatusOK {
+			return ErrIllegalMsg
+		}
+		return &Error{np.code, np.msg}
 	}
 
 	secret := dh64.Secret(priKey, np.key.Uint64())
@@ -331,6 +337,13 @@ OuterLoop:
 		oldConn := c.config.ScpServer.QueryByID(rq.id)
 		if oldConn == nil {
 			rp.code = SCPStatusIDNotFound
+			// only tell reason to the owner of closed conn
+			if reasoner, ok := c.config.ScpServer.(CloseReasoner); ok {
+				if reason, secret := reasoner.CloseReason(rq.id); reason != "" && rq.verifySum(toLeu64(secret)) {
+					rp.code = SCPStatusGone
+					rp.msg = reason
+				}
+			}
 			break OuterLoop
 		}
 
@@ -388,6 +401,25 @@ OuterLoop:
 }
 
 func (c *Conn) serverNewHandshake(nq *newConnReq) error {
+	// set preferred target
+	c.config.TargetServer = nq.targetServer
+	// set config flag
+	c.config.Flag = nq.flag
+	c.config.HashKey = nq.hashKey
+
+	if filter, ok := c.config.ScpServer.(NewConnFilter); ok {
+		if serr := filter.AcceptNewConn(c); serr != nil {
+			np := &newConnResp{
+				code: serr.Code,
+				msg:  serr.Desc,
+			}
+			if err := c.writeRecord(np); err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+
 	priKey := dh64.PrivateKey()
 	pubKey := dh64.PublicKey(priKey)
 
@@ -404,11 +436,6 @@ func (c *Conn) serverNewHandshake(nq *newConnReq) error {
 
 	secret := dh64.Secret(priKey, nq.key.Uint64())
 	c.initNewConn(id, toLeu64(secret))
-
-	// set preferred target
-	c.config.TargetServer = nq.targetServer
-	// set config flag
-	c.config.Flag = nq.flag
 	return nil
 }
 
@@ -547,6 +574,11 @@ func (c *Conn) ID() int {
 	return c.id
 }
 
+// Secret returns the shared secret of conn, 0 if handshake is not done
+func (c *Conn) Secret() uint64 {
+	return c.secret.Uint64()
+}
+
 // IsReused .
 func (c *Conn) IsReused() bool {
 	return c.reused
@@ -557,6 +589,16 @@ func (c *Conn) ReuseState() int {
 	return c.resend
 }
 
+// ReuseBufferLen returns length of data cached for reuse, and size of reuse buffer
+func (c *Conn) ReuseBufferLen() (int, int) {
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+	if c.reuseBuffer == nil {
+		return 0, 0
+	}
+	return c.reuseBuffer.Len(), c.reuseBuffer.Cap()
+}
+
 // IsServerConn .
 func (c *Conn) IsServerConn() bool {
 	return c.config.ScpServer != nil
@@ -567,6 +609,16 @@ func (c *Conn) TargetServer() string {
 	return c.config.TargetServer
 }
 
+// Flag returns flag of handshake
+func (c *Conn) Flag() int {
+	return c.config.Flag
+}
+
+// HashKey returns hash key of handshake, empty if client doesn't send it
+func (c *Conn) HashKey() string {
+	return c.config.HashKey
+}
+
 // ForbidForwardIP .
 func (c *Conn) ForbidForwardIP() bool {
 	return c.config.Flag&SCPFlagForbidForwardIP > 0
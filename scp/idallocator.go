@@ -25,6 +25,32 @@ func (o *IDAllocator) AcquireID() int {
 	return id
 }
 
+// ReserveID marks id as acquired, id should be released by ReleaseID later
+func (o *IDAllocator) ReserveID(id int) bool {
+	o.Lock()
+	defer o.Unlock()
+
+	if id < o.start {
+		return false
+	}
+
+	if id >= o.off {
+		for i := o.off; i < id; i++ {
+			o.free = append(o.free, i)
+		}
+		o.off = id + 1
+		return true
+	}
+
+	for i, v := range o.free {
+		if v == id {
+			o.free = append(o.free[:i], o.free[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
 func (o *IDAllocator) ReleaseID(id int) {
 	o.Lock()
 	defer o.Unlock()
@@ -48,6 +74,24 @@ func (o *IDAllocator) ReleaseID(id int) {
 	}
 }
 
+// Acquired returns ids acquired and not released in ascending order, and the smallest id never acquired
+func (o *IDAllocator) Acquired() ([]int, int) {
+	o.Lock()
+	defer o.Unlock()
+
+	free := make(map[int]bool, len(o.free))
+	for _, id := range o.free {
+		free[id] = true
+	}
+	ids := make([]int, 0, o.off-o.start-len(o.free))
+	for id := o.start; id < o.off; id++ {
+		if !free[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids, o.off
+}
+
 func NewIDAllocator(start int) *IDAllocator {
 	if start < 0 {
 		panic("start < 0")
@@ -32,3 +32,45 @@ func TestIDAllocator(t *testing.T) {
 		t.Errorf("Start ID")
 	}
 }
+
+func TestIDAllocatorReserve(t *testing.T) {
+	start := 1
+	allocator := NewIDAllocator(start)
+
+	if !allocator.ReserveID(3) {
+		t.Errorf("Reserve ID")
+	}
+	if allocator.ReserveID(3) {
+		t.Errorf("Reserve ID twice")
+	}
+
+	ids := map[int]bool{}
+	for i := 0; i < 3; i++ {
+		ids[allocator.AcquireID()] = true
+	}
+	if ids[3] || !ids[1] || !ids[2] || !ids[4] {
+		t.Errorf("Acquire ID: %v", ids)
+	}
+
+	for id := range ids {
+		allocator.ReleaseID(id)
+	}
+	allocator.ReleaseID(3)
+	if allocator.AcquireID() != start {
+		t.Errorf("Start ID")
+	}
+}
+
+func TestIDAllocatorAcquired(t *testing.T) {
+	allocator := NewIDAllocator(1)
+	for i := 0; i < 5; i++ {
+		allocator.AcquireID()
+	}
+	allocator.ReleaseID(2)
+	allocator.ReleaseID(4)
+
+	ids, next := allocator.Acquired()
+	if len(ids) != 3 || ids[0] != 1 || ids[1] != 3 || ids[2] != 5 || next != 6 {
+		t.Errorf("Acquired: ids=%v, next=%d", ids, next)
+	}
+}
@@ -45,10 +45,15 @@ type newConnReq struct {
 	targetServer string
 	// 32 bit flag for different extension, see SCPFlag
 	flag int
+	// optional, key of client for consistent hashing
+	hashKey string
 }
 
 func (r *newConnReq) marshal() []byte {
 	s := fmt.Sprintf("%d\n%s\n%s\n%d", r.id, b64encodeLeu64(r.key), r.targetServer, r.flag)
+	if r.hashKey != "" {
+		s += "\n" + r.hashKey
+	}
 	return []byte(s)
 }
 
@@ -76,15 +81,27 @@ func (r *newConnReq) unmarshal(s []byte) (err error) {
 			return
 		}
 	}
+
+	if len(lines) >= 5 {
+		r.hashKey = lines[4]
+	}
 	return
 }
 
 type newConnResp struct {
 	id  int
 	key leu64
+
+	// id == 0 means the new connection is refused
+	code int
+	msg  string
 }
 
 func (r *newConnResp) marshal() []byte {
+	if r.id == 0 {
+		s := fmt.Sprintf("0\n%d %s", r.code, r.msg)
+		return []byte(s)
+	}
 	s := fmt.Sprintf("%d\n%s", r.id, b64encodeLeu64(r.key))
 	return []byte(s)
 }
@@ -100,6 +117,17 @@ func (r *newConnResp) unmarshal(s []byte) (err error) {
 		return
 	}
 
+	if r.id == 0 {
+		fields := strings.SplitN(lines[1], " ", 2)
+		if r.code, err = strconv.Atoi(fields[0]); err != nil {
+			return
+		}
+		if len(fields) > 1 {
+			r.msg = fields[1]
+		}
+		return
+	}
+
 	if r.key, err = b64decodeLeu64(lines[1]); err != nil {
 		return
 	}
@@ -159,10 +187,14 @@ func (r *reuseConnReq) unmarshal(s []byte) (err error) {
 type reuseConnResp struct {
 	received uint32
 	code     int
+	msg      string // optional
 }
 
 func (r *reuseConnResp) marshal() []byte {
 	s := fmt.Sprintf("%d\n%d", r.received, r.code)
+	if r.msg != "" {
+		s = s + " " + r.msg
+	}
 	return []byte(s)
 }
 
@@ -179,9 +211,13 @@ func (r *reuseConnResp) unmarshal(s []byte) (err error) {
 	}
 	r.received = uint32(received)
 
-	if r.code, err = strconv.Atoi(lines[1]); err != nil {
+	fields := strings.SplitN(lines[1], " ", 2)
+	if r.code, err = strconv.Atoi(fields[0]); err != nil {
 		return
 	}
+	if len(fields) > 1 {
+		r.msg = fields[1]
+	}
 	return nil
 }
 
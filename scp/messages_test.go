@@ -0,0 +1,28 @@
+package scp
+
+import (
+	"testing"
+)
+
+func TestNewConnReq(t *testing.T) {
+	key := toLeu64(1234)
+	cases := []struct {
+		req  newConnReq
+		data string
+	}{
+		{newConnReq{key: key}, "0\n" + b64encodeLeu64(key) + "\n\n0"},
+		{newConnReq{key: key, targetServer: "game", flag: SCPFlagForbidForwardIP}, "0\n" + b64encodeLeu64(key) + "\ngame\n1"},
+		{newConnReq{key: key, targetServer: "game", hashKey: "player1"}, "0\n" + b64encodeLeu64(key) + "\ngame\n0\nplayer1"},
+	}
+	for i, c := range cases {
+		if data := string(c.req.marshal()); data != c.data {
+			t.Errorf("case %d: marshal %q, want %q", i, data, c.data)
+		}
+		var req newConnReq
+		if err := req.unmarshal([]byte(c.data)); err != nil {
+			t.Errorf("case %d: unmarshal: %s", i, err.Error())
+		} else if req != c.req {
+			t.Errorf("case %d: unmarshal %+v, want %+v", i, req, c.req)
+		}
+	}
+}
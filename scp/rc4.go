@@ -0,0 +1,80 @@
+package scp
+
+import (
+	"errors"
+)
+
+var errInvalidCipherState = errors.New("invalid cipher state")
+
+// size of marshaled rc4 state: s-box, i and j
+const rc4StateSize = 256 + 2
+
+// rc4Cipher is the same as crypto/rc4, except that its state can be marshaled,
+// so that a conn can be handed over without replaying the key stream.
+type rc4Cipher struct {
+	s    [256]uint32
+	i, j uint8
+}
+
+// newRC4Cipher creates a cipher, key should be 1 to 256 bytes
+func newRC4Cipher(key []byte) *rc4Cipher {
+	c := &rc4Cipher{}
+	for i := 0; i < 256; i++ {
+		c.s[i] = uint32(i)
+	}
+	var j uint8
+	for i := 0; i < 256; i++ {
+		j += uint8(c.s[i]) + key[i%len(key)]
+		c.s[i], c.s[j] = c.s[j], c.s[i]
+	}
+	return c
+}
+
+// XORKeyStream sets dst to the result of XORing src with the key stream
+func (c *rc4Cipher) XORKeyStream(dst, src []byte) {
+	if len(src) == 0 {
+		return
+	}
+	i, j := c.i, c.j
+	_ = dst[len(src)-1]
+	dst = dst[:len(src)] // eliminate bounds check
+	for k, v := range src {
+		i++
+		x := c.s[i]
+		j += uint8(x)
+		y := c.s[j]
+		c.s[i], c.s[j] = y, x
+		dst[k] = v ^ uint8(c.s[uint8(x+y)])
+	}
+	c.i, c.j = i, j
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (c *rc4Cipher) MarshalBinary() ([]byte, error) {
+	b := make([]byte, rc4StateSize)
+	for i, v := range c.s {
+		b[i] = uint8(v)
+	}
+	b[256] = c.i
+	b[257] = c.j
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (c *rc4Cipher) UnmarshalBinary(b []byte) error {
+	if len(b) != rc4StateSize {
+		return errInvalidCipherState
+	}
+	// s-box must be a permutation
+	var seen [256]bool
+	for i := 0; i < 256; i++ {
+		if seen[b[i]] {
+			return errInvalidCipherState
+		}
+		seen[b[i]] = true
+		c.s[i] = uint32(b[i])
+	}
+	c.i = b[256]
+	c.j = b[257]
+	return nil
+}
@@ -0,0 +1,58 @@
+package scp
+
+import (
+	"bytes"
+	"crypto/rc4"
+	"testing"
+)
+
+func TestRC4Cipher(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	expected, _ := rc4.NewCipher(key)
+	c := newRC4Cipher(key)
+
+	for _, sz := range []int{0, 1, 7, 256, 1000, 4096} {
+		src := make([]byte, sz)
+		for i := range src {
+			src[i] = byte(i * 7)
+		}
+		want := make([]byte, sz)
+		got := make([]byte, sz)
+		expected.XORKeyStream(want, src)
+		c.XORKeyStream(got, src)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("size %d: key stream differs from crypto/rc4", sz)
+		}
+	}
+}
+
+func TestRC4CipherState(t *testing.T) {
+	c := newRC4Cipher([]byte("secret"))
+	buf := make([]byte, 12345)
+	c.XORKeyStream(buf, buf)
+
+	state, err := c.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newRC4Cipher([]byte("other"))
+	if err := restored.UnmarshalBinary(state); err != nil {
+		t.Fatal(err)
+	}
+
+	want := make([]byte, 1000)
+	got := make([]byte, 1000)
+	c.XORKeyStream(want, want)
+	restored.XORKeyStream(got, got)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("restored cipher differs")
+	}
+
+	if err := restored.UnmarshalBinary(state[:100]); err != errInvalidCipherState {
+		t.Errorf("short state: %v", err)
+	}
+	state[0] = state[1] // not a permutation
+	if err := restored.UnmarshalBinary(state); err != errInvalidCipherState {
+		t.Errorf("invalid s-box: %v", err)
+	}
+}
@@ -16,6 +16,21 @@ type SCPServer interface {
 	QueryByID(id int) *Conn
 }
 
+// NewConnFilter is an optional interface implemented by SCPServer,
+// to refuse a new connection before an id is allocated.
+type NewConnFilter interface {
+	// AcceptNewConn returns an error to refuse conn, conn.TargetServer() is available
+	AcceptNewConn(conn *Conn) *Error
+}
+
+// CloseReasoner is an optional interface implemented by SCPServer,
+// to tell client why a conn is closed by server when client tries to reuse it.
+type CloseReasoner interface {
+	// CloseReason returns reason and secret of the closed conn if conn of id is closed by server,
+	// otherwise empty string. Reason is told only if checksum of reuse request is verified by secret.
+	CloseReason(id int) (reason string, secret uint64)
+}
+
 type Config struct {
 	// Flag
 	// for client
@@ -25,6 +40,10 @@ type Config struct {
 	// for client
 	TargetServer string
 
+	// key for consistent hashing of upstream hosts, e.g. account of player
+	// for client
+	HashKey string
+
 	// reused conn
 	// for client
 	ConnForReused *Conn
@@ -0,0 +1,110 @@
+package scp
+
+import (
+	"net"
+)
+
+// State is the snapshot of a conn, used to restore the conn in another process
+type State struct {
+	ID            int    `json:"id"`
+	Secret        uint64 `json:"secret"`
+	Handshakes    int    `json:"handshakes"`
+	BytesReceived int    `json:"bytes_received"`
+	BytesSent     int    `json:"bytes_sent"`
+	ReuseBuffer   []byte `json:"reuse_buffer"`
+	TargetServer  string `json:"target_server"`
+	Flag          int    `json:"flag"`
+	HashKey       string `json:"hash_key,omitempty"`
+	Reused        bool   `json:"reused"`
+	// state of ciphers, key stream is replayed by bytes transferred if absent
+	InCipher  []byte `json:"in_cipher,omitempty"`
+	OutCipher []byte `json:"out_cipher,omitempty"`
+}
+
+// discardKeyStream advances the key stream by n bytes
+func discardKeyStream(cipher *rc4Cipher, n int) {
+	buf := defaultBufferPool.Get(NetBufferSize)
+	defer defaultBufferPool.Put(buf)
+	b := buf.Bytes()[:NetBufferSize]
+	for n > 0 {
+		sz := n
+		if sz > len(b) {
+			sz = len(b)
+		}
+		cipher.XORKeyStream(b[:sz], b[:sz])
+		n -= sz
+	}
+}
+
+// State returns state of a handshaked conn. It should be called when c is not being read or written.
+func (c *Conn) State() (*State, error) {
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+
+	if !c.handshaked || c.reuseBuffer == nil {
+		return nil, ErrNotAcceptable
+	}
+
+	c.in.Lock()
+	defer c.in.Unlock()
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	reuseBuffer, _ := c.reuseBuffer.ReadLastBytes(c.reuseBuffer.Len())
+	inCipher, _ := c.in.cipher.MarshalBinary()
+	outCipher, _ := c.out.cipher.MarshalBinary()
+	return &State{
+		ID:            c.id,
+		Secret:        c.secret.Uint64(),
+		Handshakes:    c.handshakes,
+		BytesReceived: c.in.count,
+		BytesSent:     c.out.count,
+		ReuseBuffer:   reuseBuffer,
+		TargetServer:  c.config.TargetServer,
+		Flag:          c.config.Flag,
+		HashKey:       c.config.HashKey,
+		Reused:        c.reused,
+		InCipher:      inCipher,
+		OutCipher:     outCipher,
+	}, nil
+}
+
+// RawConn returns the underlying conn
+func (c *Conn) RawConn() net.Conn {
+	return c.conn
+}
+
+// restoreCipher restores cipher by marshaled state, or replays key stream by n bytes
+func restoreCipher(cipher *rc4Cipher, state []byte, n int) {
+	if state != nil && cipher.UnmarshalBinary(state) == nil {
+		return
+	}
+	discardKeyStream(cipher, n)
+}
+
+// Restore creates a handshaked conn on conn by state.
+// Without cipher state, e.g. state of an older version, rebuilding cipher costs time in proportion to bytes transferred.
+func Restore(conn net.Conn, config *Config, state *State) *Conn {
+	if config.ScpServer != nil {
+		config = config.clone()
+	}
+	config.TargetServer = state.TargetServer
+	config.Flag = state.Flag
+	config.HashKey = state.HashKey
+
+	c := &Conn{
+		conn:       conn,
+		config:     config,
+		handshaked: true,
+		handshakes: state.Handshakes,
+	}
+	c.initNewConn(state.ID, toLeu64(state.Secret))
+	c.reused = state.Reused
+
+	restoreCipher(c.in.cipher, state.InCipher, state.BytesReceived)
+	c.in.count = state.BytesReceived
+	restoreCipher(c.out.cipher, state.OutCipher, state.BytesSent)
+	c.out.count = state.BytesSent
+	c.reuseBuffer.Write(state.ReuseBuffer)
+	return c
+}
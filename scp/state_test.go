@@ -0,0 +1,125 @@
+package scp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+type testServer struct {
+	ids *IDAllocator
+}
+
+func (s *testServer) AcquireID() int         { return s.ids.AcquireID() }
+func (s *testServer) ReleaseID(id int)       { s.ids.ReleaseID(id) }
+func (s *testServer) QueryByID(id int) *Conn { return nil }
+
+func testTransfer(t *testing.T, client *Conn, server *Conn, data []byte) {
+	go client.Write(data)
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatalf("Read: %s", err.Error())
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatalf("Read Unequal, get:% x, expected:% x", buf, data)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	ss := &testServer{ids: NewIDAllocator(1)}
+
+	c1, c2 := net.Pipe()
+	client, _ := Client(c1, &Config{TargetServer: "game", HashKey: "player1"})
+	server := Server(c2, &Config{ScpServer: ss})
+	go client.Handshake()
+	if err := server.Handshake(); err != nil {
+		t.Fatalf("Handshake: %s", err.Error())
+	}
+
+	testTransfer(t, client, server, []byte("hello"))
+	testTransfer(t, server, client, []byte("world"))
+
+	clientState, err := client.State()
+	if err != nil {
+		t.Fatalf("State: %s", err.Error())
+	}
+	serverState, err := server.State()
+	if err != nil {
+		t.Fatalf("State: %s", err.Error())
+	}
+	if serverState.TargetServer != "game" || serverState.HashKey != "player1" || serverState.BytesReceived != 5 || serverState.BytesSent != 5 {
+		t.Fatalf("State: %+v", serverState)
+	}
+	if len(serverState.ReuseBuffer) != 5 {
+		t.Fatalf("State ReuseBuffer: % x", serverState.ReuseBuffer)
+	}
+	if len(serverState.InCipher) != rc4StateSize || len(serverState.OutCipher) != rc4StateSize {
+		t.Fatalf("State cipher: in=%d, out=%d", len(serverState.InCipher), len(serverState.OutCipher))
+	}
+
+	// state without ciphers, as an older version hands over, replays key stream
+	legacyState := *clientState
+	legacyState.InCipher = nil
+	legacyState.OutCipher = nil
+
+	c1, c2 = net.Pipe()
+	client = Restore(c1, &Config{}, &legacyState)
+	server = Restore(c2, &Config{ScpServer: ss}, serverState)
+	if server.ID() != serverState.ID || server.TargetServer() != "game" || server.HashKey() != "player1" {
+		t.Fatalf("Restore: id=%d, target=%s, hash key=%s", server.ID(), server.TargetServer(), server.HashKey())
+	}
+
+	testTransfer(t, client, server, []byte("hello again"))
+	testTransfer(t, server, client, []byte("world again"))
+}
+
+type closedServer struct {
+	testServer
+	reason string
+	secret uint64
+}
+
+func (s *closedServer) CloseReason(id int) (string, uint64) { return s.reason, s.secret }
+
+func testReuseClosed(t *testing.T, ss *closedServer, old *Conn) error {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	client, err := Client(c1, &Config{ConnForReused: old})
+	if err != nil {
+		t.Fatalf("Client: %s", err.Error())
+	}
+	server := Server(c2, &Config{ScpServer: ss})
+	go server.Handshake()
+	return client.Handshake()
+}
+
+func TestReuseClosed(t *testing.T) {
+	ss := &closedServer{testServer: testServer{ids: NewIDAllocator(1)}, reason: "kicked"}
+
+	c1, c2 := net.Pipe()
+	client, _ := Client(c1, &Config{})
+	server := Server(c2, &Config{ScpServer: ss})
+	go client.Handshake()
+	if err := server.Handshake(); err != nil {
+		t.Fatalf("Handshake: %s", err.Error())
+	}
+	ss.secret = server.Secret()
+
+	state, err := client.State()
+	if err != nil {
+		t.Fatalf("State: %s", err.Error())
+	}
+	state.Secret++
+	forged := Restore(c1, &Config{}, state)
+
+	// reason is hidden from client without the secret
+	if err := testReuseClosed(t, ss, forged); err != ErrIDNotFound {
+		t.Errorf("reuse with wrong secret: %v", err)
+	}
+	err = testReuseClosed(t, ss, client)
+	if e, ok := err.(*Error); !ok || e.Code != SCPStatusGone || e.Desc != "kicked" {
+		t.Errorf("reuse closed conn: %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ejoy/goscon/scp"
@@ -16,23 +17,127 @@ var copyPool = sync.Pool{
 	},
 }
 
+// state of connPair, for handoff
+const (
+	pairConnecting int32 = iota
+	pairPumping
+	pairSuspending
+)
+
 type connPair struct {
 	LocalConn  net.Conn // scp server <-> local server
 	RemoteConn *SCPConn // client <-> scp server
+
+	Host *upstream.Host // upstream host of LocalConn
+
+	// data read but not written, restored from handoff
+	pendingC2S []byte
+	pendingS2C []byte
+
+	state     int32              // atomic
+	suspended chan []*pumpResult // receives results of pumps when the pair is suspended
+	pumpEnded int32              // atomic, set by the first finished pump
+	ending    chan struct{}      // closed when the first pump finishes, interrupts throttle wait of the other
+
+	createdAt   time.Time
+	connectedAt time.Time // upstream connected
+	limitKey    string    // key of session in limiter
+	reuses      int64     // atomic
+
+	mutex       sync.Mutex
+	clientIPs   []string // distinct ips of client across reuses
+	closeReason string   // set if pair is closed by server
+
+	// traffic, atomic
+	c2sBytes   int64
+	c2sPackets int64
+	s2cBytes   int64
+	s2cPackets int64
+}
+
+type pumpResult struct {
+	tag       string
+	written   int
+	packets   int
+	readErr   error  // error on src
+	writeErr  error  // error on dst
+	suspended bool   // pump is stopped by suspend
+	pending   []byte // data read but not written when suspended
+	first     bool   // pump is finished before the other one closes conns
+}
+
+func (p *connPair) setCloseReason(reason string) {
+	p.mutex.Lock()
+	p.closeReason = reason
+	p.mutex.Unlock()
+}
+
+func (p *connPair) getCloseReason() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.closeReason
+}
+
+func (p *connPair) isSuspending() bool {
+	return atomic.LoadInt32(&p.state) == pairSuspending
+}
+
+// isSuspendErr reports whether err is caused by suspend
+func (p *connPair) isSuspendErr(err error) bool {
+	if !p.isSuspending() {
+		return false
+	}
+	if err == errConnSuspended {
+		return true
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return false
 }
 
-func pump(id int, tag string, dst net.Conn, src net.Conn, ch chan<- int) error {
+func (p *connPair) pump(tag string, dst net.Conn, src net.Conn, pending []byte, perIP *ipBuckets, ch chan<- *pumpResult) {
+	id := p.RemoteConn.ID()
 	var err error
 	var written, packets int
+	var readErr, writeErr error
+	var suspended bool
 	buf := copyPool.Get().([]byte)
 	defer copyPool.Put(buf)
 
-	for {
+	pairBytes, pairPackets := &p.c2sBytes, &p.c2sPackets
+	if tag == "s2c" {
+		pairBytes, pairPackets = &p.s2cBytes, &p.s2cPackets
+	}
+	host := hostLabel(p.Host)
+	bytesCounter := trafficBytes.WithLabelValues(tag, host, p.RemoteConn.target)
+	packetsCounter := trafficPackets.WithLabelValues(tag, host, p.RemoteConn.target)
+	throttle := &throttler{
+		tag:    tag,
+		target: p.RemoteConn.Current().TargetServer(),
+		ip:     perIP,
+	}
+
+	if len(pending) > 0 {
+		nw, ew := dst.Write(pending)
+		if ew != nil {
+			err = ew
+			writeErr = ew
+			suspended = p.isSuspendErr(ew)
+			pending = pending[nw:]
+		} else {
+			pending = nil
+		}
+	}
+
+	for err == nil {
 		nr, er := src.Read(buf)
 		if glog.V(2) {
 			glog.Infof("recv packet: id=%d, tag=%s, addr=%s, sz=%d, err=%v", id, tag, src.RemoteAddr(), nr, er)
 		}
 		if nr > 0 {
+			// pair is ending if wait is interrupted, write fails or data is kept for handoff
+			throttle.wait(nr, p.ending)
 			nw, ew := dst.Write(buf[0:nr])
 			if glog.V(2) {
 				glog.Infof("send packet: id=%d, tag=%s, addr=%s, sz=%d, err=%v", id, tag, dst.RemoteAddr(), nw, ew)
@@ -40,14 +145,24 @@ func pump(id int, tag string, dst net.Conn, src net.Conn, ch chan<- int) error {
 			if nw > 0 {
 				packets++
 				written += nw
+				atomic.AddInt64(pairPackets, 1)
+				atomic.AddInt64(pairBytes, int64(nw))
+				packetsCounter.Inc()
+				bytesCounter.Add(float64(nw))
 			}
 			if ew != nil {
 				err = ew
+				writeErr = ew
+				if suspended = p.isSuspendErr(ew); suspended && nw < nr {
+					pending = append([]byte(nil), buf[nw:nr]...)
+				}
 				break
 			}
 		}
 		if er != nil {
 			err = er
+			readErr = er
+			suspended = p.isSuspendErr(er)
 			break
 		}
 	}
@@ -56,29 +171,90 @@ func pump(id int, tag string, dst net.Conn, src net.Conn, ch chan<- int) error {
 		glog.Infof("pair pump: id=%d, tag=%s, addr1=%s, addr2=%s, err=%v", id, tag, src.RemoteAddr(), dst.RemoteAddr(), err)
 	}
 
-	src.Close()
-	dst.Close()
+	first := atomic.CompareAndSwapInt32(&p.pumpEnded, 0, 1)
+	if first {
+		close(p.ending)
+	}
+
+	// keep conns for handoff
+	if !suspended {
+		src.Close()
+		dst.Close()
+	}
 
-	ch <- written
-	ch <- packets
-	return err
+	ch <- &pumpResult{
+		first:     first,
+		tag:       tag,
+		written:   written,
+		packets:   packets,
+		readErr:   readErr,
+		writeErr:  writeErr,
+		suspended: suspended,
+		pending:   pending,
+	}
 }
 
 func (p *connPair) Pump() {
 	glog.Infof("pair new: id=%d, client=%s->%s, server=%s->%s", p.RemoteConn.ID(), p.RemoteConn.RemoteAddr(),
 		p.RemoteConn.LocalAddr(), p.LocalConn.LocalAddr(), p.LocalConn.RemoteAddr())
-	downloadCh := make(chan int)
-	uploadCh := make(chan int)
-
-	go pump(p.RemoteConn.ID(), "c2s", p.LocalConn, p.RemoteConn, downloadCh)
-	go pump(p.RemoteConn.ID(), "s2c", p.RemoteConn, p.LocalConn, uploadCh)
-
-	dlData := <-downloadCh
-	dlPackets := <-downloadCh
-	ulData := <-uploadCh
-	ulPackets := <-uploadCh
-	glog.Infof("pair remove: id=%d, client=%s, server=%s, c2s=%d/%d, s2c=%d/%d", p.RemoteConn.ID(),
-		p.RemoteConn.RemoteAddr(), p.LocalConn.LocalAddr(), dlData, dlPackets, ulData, ulPackets)
+	start := time.Now()
+	ch := make(chan *pumpResult, 2)
+
+	p.suspended = make(chan []*pumpResult, 1)
+	p.ending = make(chan struct{})
+	atomic.StoreInt32(&p.state, pairPumping)
+
+	conns := upstreamConns.WithLabelValues(p.RemoteConn.listener, p.RemoteConn.target, hostLabel(p.Host))
+	conns.Inc()
+	defer conns.Dec()
+
+	// rate of all sessions from the ip when pair starts is limited by throttle.per_ip
+	clientIP := ipOf(p.RemoteConn.RemoteAddr())
+	perIP := acquireIPBuckets(clientIP)
+	defer releaseIPBuckets(clientIP)
+
+	go p.pump("c2s", p.LocalConn, p.RemoteConn, p.pendingC2S, perIP, ch)
+	go p.pump("s2c", p.RemoteConn, p.LocalConn, p.pendingS2C, perIP, ch)
+
+	// the first finished pump tells which side ends the pair
+	first := <-ch
+	second := <-ch
+	if second.first {
+		first, second = second, first
+	}
+
+	download, upload := first, second
+	if download.tag != "c2s" {
+		download, upload = upload, download
+	}
+
+	if p.isSuspending() {
+		if first.suspended && second.suspended {
+			p.suspended <- []*pumpResult{download, upload}
+			glog.Infof("pair suspend: id=%d, client=%s, server=%s, c2s=%d/%d, s2c=%d/%d", p.RemoteConn.ID(),
+				p.RemoteConn.RemoteAddr(), p.LocalConn.LocalAddr(), download.written, download.packets, upload.written, upload.packets)
+			return
+		}
+		// pair is ended while suspending
+		p.RemoteConn.Close()
+		p.LocalConn.Close()
+		p.suspended <- nil
+	}
+
+	var upstreamErr error
+	if first.tag == "c2s" {
+		upstreamErr = first.writeErr
+	} else {
+		upstreamErr = first.readErr
+	}
+	p.Host.Release(time.Since(start), upstreamErr)
+
+	reason := p.closeReasonOf(first)
+	connectionCloseReasons.WithLabelValues(reason).Inc()
+	glog.Infof("pair remove: id=%d, client=%s, server=%s, c2s=%d/%d, s2c=%d/%d, reason=%s, client_break=%s", p.RemoteConn.ID(),
+		p.RemoteConn.RemoteAddr(), p.LocalConn.LocalAddr(), download.written, download.packets, upload.written, upload.packets,
+		reason, p.RemoteConn.BreakReason())
+	accessLog.Log(p.accessRecord(reason, time.Now()))
 }
 
 // SCPServer implements scp.SCPServer
@@ -87,25 +263,48 @@ type SCPServer struct {
 
 	connPairMutex sync.Mutex
 	connPairs     map[int]*connPair
-}
 
-var defaultServer = &SCPServer{
-	idAllocator: scp.NewIDAllocator(1),
-	connPairs:   make(map[int]*connPair),
+	listenerMutex sync.Mutex
+	listeners     []net.Listener
+
+	// limit keys of new sessions reserved by AcceptNewConn, before pairs are added
+	reservedMutex sync.Mutex
+	reserved      map[*scp.Conn]string
+
+	draining    int32 // atomic, 1 means draining
+	drainMutex  sync.Mutex
+	drainStatus DrainStatus
+
+	// reason of pairs closed by manager, told to client when reuse
+	closeReasonMutex sync.Mutex
+	closeReasons     map[int]closeReason
+
+	// ids of sessions handed over by upgrade
+	handoff handoffIDs
 }
 
-// AcquireID implments scp.SCPServer interface
-func (ss *SCPServer) AcquireID() int {
-	return ss.idAllocator.AcquireID()
+type closeReason struct {
+	reason   string
+	secret   uint64 // secret of closed conn, to verify reuse request
+	expireAt time.Time
 }
 
-// ReleaseID implments scp.SCPServer interface
-func (ss *SCPServer) ReleaseID(id int) {
-	ss.idAllocator.ReleaseID(id)
+var defaultServer = &SCPServer{
+	idAllocator: scp.NewIDAllocator(1),
+	connPairs:   make(map[int]*connPair),
+	reserved:    make(map[*scp.Conn]string),
 }
 
 // QueryByID implments scp.SCPServer interface
+// Reuse of a session being handed over by upgrade waits for it.
 func (ss *SCPServer) QueryByID(id int) *scp.Conn {
+	if conn := ss.queryByID(id); conn != nil || !ss.waitHandoffID(id) {
+		return conn
+	}
+	return ss.queryByID(id)
+}
+
+func (ss *SCPServer) queryByID(id int) *scp.Conn {
 	ss.connPairMutex.Lock()
 	defer ss.connPairMutex.Unlock()
 	pair := ss.connPairs[id]
@@ -123,12 +322,69 @@ func (ss *SCPServer) addConnPair(id int, pair *connPair) {
 		panic(id)
 	}
 	ss.connPairs[id] = pair
+	sessions.WithLabelValues(pair.RemoteConn.listener, pair.RemoteConn.target).Inc()
+	// id is reused by a new pair
+	ss.setCloseReason(id, "", 0)
+}
+
+// CloseReason implements scp.CloseReasoner interface
+func (ss *SCPServer) CloseReason(id int) (string, uint64) {
+	ss.closeReasonMutex.Lock()
+	defer ss.closeReasonMutex.Unlock()
+	r, ok := ss.closeReasons[id]
+	if !ok {
+		return "", 0
+	}
+	if time.Now().After(r.expireAt) {
+		delete(ss.closeReasons, id)
+		return "", 0
+	}
+	return r.reason, r.secret
+}
+
+// setCloseReason records reason of id until reuse timeout, or removes it if reason is empty
+func (ss *SCPServer) setCloseReason(id int, reason string, secret uint64) {
+	ss.closeReasonMutex.Lock()
+	defer ss.closeReasonMutex.Unlock()
+	if reason == "" {
+		delete(ss.closeReasons, id)
+		return
+	}
+	if ss.closeReasons == nil {
+		ss.closeReasons = make(map[int]closeReason)
+	}
+	now := time.Now()
+	for k, r := range ss.closeReasons {
+		if now.After(r.expireAt) {
+			delete(ss.closeReasons, k)
+		}
+	}
+	ss.closeReasons[id] = closeReason{
+		reason:   reason,
+		secret:   secret,
+		expireAt: now.Add(configItemTime("scp.reuse_time")),
+	}
+}
+
+// kick closes pair, reason is told to client if it tries to reuse
+func (ss *SCPServer) kick(pair *connPair, reason string) {
+	if reason != "" {
+		ss.setCloseReason(pair.RemoteConn.ID(), reason, pair.RemoteConn.Current().Secret())
+	}
+	pair.setCloseReason(reasonKick)
+	// pumps close both conns
+	pair.RemoteConn.Close()
+	connectionKicks.Inc()
 }
 
 func (ss *SCPServer) removeConnPair(id int) {
 	ss.connPairMutex.Lock()
 	defer ss.connPairMutex.Unlock()
-	delete(ss.connPairs, id)
+	if pair, ok := ss.connPairs[id]; ok {
+		defaultLimiter.removeSession(pair.limitKey)
+		sessions.WithLabelValues(pair.RemoteConn.listener, pair.RemoteConn.target).Dec()
+		delete(ss.connPairs, id)
+	}
 }
 
 func (ss *SCPServer) getConnPair(id int) *connPair {
@@ -161,13 +417,15 @@ func (ss *SCPServer) onReuseConn(scon *scp.Conn) bool {
 	}
 
 	glog.Infof("pair reuse: id=%d, old_client=%s, new_client=%s", id, oldClientAddr, scon.RemoteAddr())
+	atomic.AddInt64(&pair.reuses, 1)
+	pair.addClientIP(scon.RemoteAddr())
 
 	connectionReuses.Inc()
 	return true
 }
 
-func newUpstreamConn(scon *scp.Conn) (conn net.Conn, err error) {
-	localconn, err := upstream.NewConn(scon)
+func newUpstreamConn(scon *scp.Conn) (conn net.Conn, host *upstream.Host, err error) {
+	localconn, host, err := upstream.NewConn(scon)
 	if err != nil {
 		return
 	}
@@ -183,23 +441,29 @@ func (ss *SCPServer) onNewConn(scon *scp.Conn) bool {
 	id := scon.ID()
 	defer ss.ReleaseID(id)
 
-	connPair := &connPair{}
+	connPair := &connPair{createdAt: time.Now()}
 	connPair.RemoteConn = NewSCPConn(scon)
+	connPair.addClientIP(scon.RemoteAddr())
+	connPair.limitKey = ss.takeReserved(scon)
 
 	// hold conn pair for reuse
 	ss.addConnPair(id, connPair)
 	defer ss.removeConnPair(id)
 
-	localConn, err := newUpstreamConn(scon)
+	localConn, host, err := newUpstreamConn(scon)
 	if err != nil {
 		scon.Close()
 		upstreamErrors.Inc()
 
 		glog.Errorf("upstream new conn failed: id=%d, client=%s, err=%s", id, scon.RemoteAddr(), err.Error())
+		connectionCloseReasons.WithLabelValues(reasonConnectFailed).Inc()
+		accessLog.Log(connPair.accessRecord(reasonConnectFailed, time.Now()))
 		return false
 	}
 
+	connPair.connectedAt = time.Now()
 	connPair.LocalConn = localConn
+	connPair.Host = host
 	connPair.Pump()
 	return true
 }
@@ -215,14 +479,32 @@ func (ss *SCPServer) handleConn(conn net.Conn) {
 		}
 	}()
 
+	if !defaultLimiter.allowHandshake(conn.RemoteAddr()) {
+		connectionRejects.WithLabelValues(rejectHandshakeRate).Inc()
+		if glog.V(1) {
+			glog.Infof("reject conn: client=%s, reason=%s", conn.RemoteAddr(), rejectHandshakeRate)
+		}
+		conn.Close()
+		return
+	}
+
 	scon := scp.Server(conn, &scp.Config{ScpServer: ss})
 
+	handshakes := handshakesInProgress.WithLabelValues(transportOf(conn))
+	handshakes.Inc()
+	atomic.AddInt64(&pendingHandshakes, 1)
 	err := scon.Handshake()
+	atomic.AddInt64(&pendingHandshakes, -1)
+	handshakes.Dec()
 
 	if err != nil {
 		glog.Errorf("scp handshake faield: client=%s, err=%s", conn.RemoteAddr().String(), err.Error())
+		ss.releaseReserved(scon)
 		scon.Close()
 		metricOnHandshakeError(err)
+		if isBanFailure(err) {
+			defaultBanTracker.OnFailure(ipOf(conn.RemoteAddr()))
+		}
 		return
 	}
 
@@ -237,6 +519,7 @@ func (ss *SCPServer) handleConn(conn net.Conn) {
 func (ss *SCPServer) Serve(l net.Listener) error {
 	addr := l.Addr().String()
 	glog.Infof("serve: addr=%s", addr)
+	ss.addListener(l)
 
 	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
@@ -265,6 +548,29 @@ func (ss *SCPServer) Serve(l net.Listener) error {
 			glog.Infof("accept new connection: client=%s", conn.RemoteAddr())
 		}
 
+		if ss.isDraining() {
+			conn.Close()
+			continue
+		}
+
+		if reason := checkACL(conn); reason != "" {
+			connectionRejects.WithLabelValues(reason).Inc()
+			if glog.V(1) {
+				glog.Infof("reject conn: client=%s, laddr=%s, reason=%s", conn.RemoteAddr(), addr, reason)
+			}
+			conn.Close()
+			continue
+		}
+
+		if defaultBanTracker.IsBanned(ipOf(conn.RemoteAddr())) {
+			connectionRejects.WithLabelValues(rejectBanned).Inc()
+			if glog.V(1) {
+				glog.Infof("reject conn: client=%s, reason=%s", conn.RemoteAddr(), rejectBanned)
+			}
+			conn.Close()
+			continue
+		}
+
 		go ss.handleConn(conn)
 	}
 }
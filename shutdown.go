@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/xjdrew/glog"
+)
+
+// DrainStatus reports progress of draining
+type DrainStatus struct {
+	Draining     bool      `json:"draining"`
+	StartedAt    time.Time `json:"started_at"`
+	Deadline     time.Time `json:"deadline"`
+	InitialPairs int       `json:"initial_pairs"`
+	Pairs        int       `json:"pairs"` // pairs still running
+}
+
+func (ss *SCPServer) isDraining() bool {
+	return atomic.LoadInt32(&ss.draining) == 1
+}
+
+func (ss *SCPServer) addListener(l net.Listener) {
+	ss.listenerMutex.Lock()
+	defer ss.listenerMutex.Unlock()
+	ss.listeners = append(ss.listeners, l)
+}
+
+// closeListeners stops accepting on all listeners
+func (ss *SCPServer) closeListeners() {
+	ss.listenerMutex.Lock()
+	defer ss.listenerMutex.Unlock()
+	for _, l := range ss.listeners {
+		// kcp sessions share the udp socket with listener, so keep it open,
+		// and Serve drops new connections when draining
+		if _, ok := l.(*KCPListener); ok {
+			continue
+		}
+		l.Close()
+	}
+}
+
+func (ss *SCPServer) pairCount() int {
+	ss.connPairMutex.Lock()
+	defer ss.connPairMutex.Unlock()
+	return len(ss.connPairs)
+}
+
+func (ss *SCPServer) closeAllPairs() {
+	ss.connPairMutex.Lock()
+	pairs := make([]*connPair, 0, len(ss.connPairs))
+	for _, pair := range ss.connPairs {
+		pairs = append(pairs, pair)
+	}
+	ss.connPairMutex.Unlock()
+
+	for _, pair := range pairs {
+		pair.setCloseReason(reasonShutdown)
+		pair.RemoteConn.Close()
+	}
+}
+
+// DrainStatus .
+func (ss *SCPServer) DrainStatus() DrainStatus {
+	ss.drainMutex.Lock()
+	status := ss.drainStatus
+	ss.drainMutex.Unlock()
+	if status.Draining {
+		status.Pairs = ss.pairCount()
+	}
+	return status
+}
+
+// Shutdown stops accepting and refuses new handshakes, then waits for existing pairs
+// to finish until timeout or force is closed. Pairs left are closed.
+func (ss *SCPServer) Shutdown(timeout time.Duration, force <-chan struct{}) {
+	now := time.Now()
+	pairs := ss.pairCount()
+	ss.drainMutex.Lock()
+	ss.drainStatus = DrainStatus{
+		Draining:     true,
+		StartedAt:    now,
+		Deadline:     now.Add(timeout),
+		InitialPairs: pairs,
+	}
+	ss.drainMutex.Unlock()
+
+	atomic.StoreInt32(&ss.draining, 1)
+	ss.closeListeners()
+	glog.Infof("drain start: pairs=%d, timeout=%v", pairs, timeout)
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for i := 1; ; i++ {
+		pairs = ss.pairCount()
+		if pairs == 0 {
+			glog.Infof("drain finished: duration=%v", time.Since(now))
+			return
+		}
+		select {
+		case <-ticker.C:
+			if i%10 == 0 {
+				glog.Infof("drain progress: pairs=%d, elapsed=%v", pairs, time.Since(now))
+			}
+		case <-deadline.C:
+			glog.Errorf("drain timeout, close pairs: pairs=%d", pairs)
+			ss.closeAllPairs()
+			ss.waitPairs(5 * time.Second)
+			return
+		case <-force:
+			glog.Errorf("drain canceled, close pairs: pairs=%d", pairs)
+			ss.closeAllPairs()
+			ss.waitPairs(5 * time.Second)
+			return
+		}
+	}
+}
+
+// waitPairs waits for closed pairs to be removed
+func (ss *SCPServer) waitPairs(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for ss.pairCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ejoy/goscon/scp"
+)
+
+// addTestPairs adds pairs removed when closed, like pairs served
+func addTestPairs(ss *SCPServer, n int) []*connPair {
+	pairs := make([]*connPair, n)
+	for i := range pairs {
+		c, _ := net.Pipe()
+		pair := &connPair{RemoteConn: NewSCPConn(scp.Restore(c, &scp.Config{}, &scp.State{ID: i + 1}))}
+		pairs[i] = pair
+		ss.connPairMutex.Lock()
+		ss.connPairs[i+1] = pair
+		ss.connPairMutex.Unlock()
+		go func(id int) {
+			pair.RemoteConn.Read(make([]byte, 1))
+			ss.connPairMutex.Lock()
+			delete(ss.connPairs, id)
+			ss.connPairMutex.Unlock()
+		}(i + 1)
+	}
+	return pairs
+}
+
+func TestShutdown(t *testing.T) {
+	cases := []struct {
+		name    string
+		pairs   int
+		timeout time.Duration
+		end     bool // pairs end by themselves
+		force   bool
+		reason  string // close reason of pairs
+		maxTime time.Duration
+	}{
+		{name: "idle", timeout: time.Hour, maxTime: 100 * time.Millisecond},
+		{name: "drained", pairs: 2, timeout: time.Hour, end: true, maxTime: 2 * time.Second},
+		{name: "timeout", pairs: 2, timeout: 100 * time.Millisecond, reason: reasonShutdown, maxTime: time.Second},
+		{name: "force", pairs: 2, timeout: time.Hour, force: true, reason: reasonShutdown, maxTime: time.Second},
+	}
+	for _, c := range cases {
+		c := c
+		ss := &SCPServer{connPairs: make(map[int]*connPair)}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss.addListener(l)
+		pairs := addTestPairs(ss, c.pairs)
+
+		force := make(chan struct{})
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			if c.end {
+				for _, pair := range pairs {
+					pair.RemoteConn.Close()
+				}
+			}
+			if c.force {
+				close(force)
+			}
+		}()
+
+		start := time.Now()
+		ss.Shutdown(c.timeout, force)
+		if d := time.Since(start); d > c.maxTime {
+			t.Errorf("%s: shutdown takes %v", c.name, d)
+		}
+
+		if !ss.isDraining() {
+			t.Errorf("%s: not draining", c.name)
+		}
+		if _, err := l.Accept(); err == nil {
+			t.Errorf("%s: listener not closed", c.name)
+		}
+		status := ss.DrainStatus()
+		if status.InitialPairs != c.pairs || status.Pairs != 0 {
+			t.Errorf("%s: status=%+v", c.name, status)
+		}
+		for _, pair := range pairs {
+			if reason := pair.getCloseReason(); reason != c.reason {
+				t.Errorf("%s: close reason=%q, want %q", c.name, reason, c.reason)
+			}
+		}
+	}
+}
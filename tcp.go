@@ -19,9 +19,22 @@ func (conn tcpConn) Read(b []byte) (int, error) {
 	return conn.TCPConn.Read(b)
 }
 
+func newTCPConn(t *net.TCPConn) net.Conn {
+	keepalive := configItemBool("tcp_option.keepalive")
+	keepaliveInterval := configItemTime("tcp_option.keepalive_interval")
+	readTimeout := configItemTime("tcp_option.read_timeout")
+
+	t.SetKeepAlive(keepalive)
+	t.SetKeepAlivePeriod(keepaliveInterval)
+	// t.SetLinger(0)
+
+	return tcpConn{t, readTimeout}
+}
+
 // TCPListener .
 type TCPListener struct {
 	net.Listener
+	laddr string // address in config
 }
 
 // Accept .
@@ -35,24 +48,22 @@ func (l *TCPListener) Accept() (conn net.Conn, err error) {
 		glog.Infof("accept new tcp connection: addr=%s", c.RemoteAddr())
 	}
 
-	keepalive := configItemBool("tcp_option.keepalive")
-	keepaliveInterval := configItemTime("tcp_option.keepalive_interval")
-	readTimeout := configItemTime("tcp_option.read_timeout")
-
-	t := c.(*net.TCPConn)
-	t.SetKeepAlive(keepalive)
-	t.SetKeepAlivePeriod(keepaliveInterval)
-	// t.SetLinger(0)
-
-	conn = tcpConn{t, readTimeout}
+	conn = newTCPConn(c.(*net.TCPConn))
 	return
 }
 
 // NewTCPListener creates a new TCPListener
 func NewTCPListener(laddr string) (*TCPListener, error) {
-	ln, err := net.Listen("tcp", laddr)
+	var ln net.Listener
+	var err error
+	if f := inheritedFile("tcp", laddr); f != nil {
+		ln, err = net.FileListener(f)
+		f.Close()
+	} else {
+		ln, err = net.Listen("tcp", laddr)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &TCPListener{ln}, nil
+	return &TCPListener{ln, laddr}, nil
 }
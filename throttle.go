@@ -0,0 +1,160 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ThrottleRate is bytes per second of each direction, 0 means unlimited
+type ThrottleRate struct {
+	C2S int `mapstructure:"c2s"`
+	S2C int `mapstructure:"s2c"`
+}
+
+func (r ThrottleRate) of(tag string) int {
+	if tag == "s2c" {
+		return r.S2C
+	}
+	return r.C2S
+}
+
+// ThrottleOption .
+type ThrottleOption struct {
+	ThrottleRate `mapstructure:",squash"` // per session
+	PerIP        ThrottleRate             `mapstructure:"per_ip"`
+	Targets      map[string]ThrottleRate  // per session, override default by targetServer (case insensitive)
+}
+
+var throttleOption atomic.Value // *ThrottleOption
+
+func init() {
+	throttleOption.Store(&ThrottleOption{})
+}
+
+// sessionRate returns rate of session with target in direction tag
+func (o *ThrottleOption) sessionRate(target string, tag string) int {
+	if r, ok := o.Targets[strings.ToLower(target)]; ok {
+		return r.of(tag)
+	}
+	return o.of(tag)
+}
+
+// cap of a single throttle wait, debt of a bucket over it is forgiven
+const maxThrottleWait = 5 * time.Second
+
+// rateBucket is a token bucket of bytes, goes negative to make sender wait
+type rateBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes n tokens, returns time to wait before sending. Burst is one second of rate,
+// and debt is limited to maxThrottleWait of rate.
+func (b *rateBucket) reserve(n int, rate int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r := float64(rate)
+	if b.last.IsZero() {
+		b.tokens = r
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * r
+		if b.tokens > r {
+			b.tokens = r
+		}
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	if debt := r * maxThrottleWait.Seconds(); -b.tokens > debt {
+		b.tokens = -debt
+	}
+	return time.Duration(-b.tokens / r * float64(time.Second))
+}
+
+// ipBuckets is shared by sessions of a client ip
+type ipBuckets struct {
+	c2s  rateBucket
+	s2c  rateBucket
+	refs int
+}
+
+func (b *ipBuckets) of(tag string) *rateBucket {
+	if tag == "s2c" {
+		return &b.s2c
+	}
+	return &b.c2s
+}
+
+var ipThrottle = struct {
+	sync.Mutex
+	buckets map[string]*ipBuckets
+}{
+	buckets: make(map[string]*ipBuckets),
+}
+
+func acquireIPBuckets(ip string) *ipBuckets {
+	ipThrottle.Lock()
+	defer ipThrottle.Unlock()
+	b, ok := ipThrottle.buckets[ip]
+	if !ok {
+		b = &ipBuckets{}
+		ipThrottle.buckets[ip] = b
+	}
+	b.refs++
+	return b
+}
+
+func releaseIPBuckets(ip string) {
+	ipThrottle.Lock()
+	defer ipThrottle.Unlock()
+	if b := ipThrottle.buckets[ip]; b != nil {
+		b.refs--
+		if b.refs == 0 {
+			delete(ipThrottle.buckets, ip)
+		}
+	}
+}
+
+// throttler delays a pump of session by rate of session and client ip
+type throttler struct {
+	tag     string
+	target  string
+	session rateBucket
+	ip      *ipBuckets
+}
+
+// wait blocks until n bytes can be sent, or done is closed.
+// Bucket of client ip is charged after session allows sending.
+func (t *throttler) wait(n int, done <-chan struct{}) {
+	option := throttleOption.Load().(*ThrottleOption)
+	if rate := option.sessionRate(t.target, t.tag); rate > 0 {
+		if !t.sleep(t.session.reserve(n, rate, time.Now()), done) {
+			return
+		}
+	}
+	if rate := option.PerIP.of(t.tag); rate > 0 {
+		t.sleep(t.ip.of(t.tag).reserve(n, rate, time.Now()), done)
+	}
+}
+
+// sleep reports whether d elapsed before done is closed
+func (t *throttler) sleep(d time.Duration, done <-chan struct{}) bool {
+	if d <= 0 {
+		return true
+	}
+	throttledSeconds.WithLabelValues(t.tag).Add(d.Seconds())
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
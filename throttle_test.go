@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateBucket(t *testing.T) {
+	now := time.Now()
+	var b rateBucket
+
+	// burst is one second of rate
+	if d := b.reserve(100, 100, now); d != 0 {
+		t.Fatalf("burst: wait=%v", d)
+	}
+	if d := b.reserve(50, 100, now); d != 500*time.Millisecond {
+		t.Fatalf("over burst: wait=%v", d)
+	}
+	// refilled by rate, the debt is paid first
+	now = now.Add(time.Second)
+	if d := b.reserve(50, 100, now); d != 0 {
+		t.Fatalf("after refilled: wait=%v", d)
+	}
+	// tokens no more than burst after idle
+	now = now.Add(time.Hour)
+	if d := b.reserve(150, 100, now); d != 500*time.Millisecond {
+		t.Fatalf("after idle: wait=%v", d)
+	}
+	// a single wait is capped
+	if d := b.reserve(100000, 100, now); d != maxThrottleWait {
+		t.Fatalf("huge reserve: wait=%v", d)
+	}
+	if d := b.reserve(100, 100, now.Add(maxThrottleWait)); d != time.Second {
+		t.Fatalf("after capped wait: wait=%v", d)
+	}
+}
+
+func TestThrottlerWait(t *testing.T) {
+	old := throttleOption.Load()
+	defer throttleOption.Store(old)
+	throttleOption.Store(&ThrottleOption{
+		ThrottleRate: ThrottleRate{C2S: 100},
+		PerIP:        ThrottleRate{C2S: 1000},
+		Targets:      map[string]ThrottleRate{"fast": {C2S: 1000000}},
+	})
+
+	ip := &ipBuckets{}
+	th := &throttler{tag: "c2s", ip: ip}
+	done := make(chan struct{})
+	th.wait(100, done)
+
+	// wait of session is interrupted by done, bucket of ip isn't charged
+	close(done)
+	start := time.Now()
+	th.wait(100, done)
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("wait not interrupted: %v", d)
+	}
+	if tokens := ip.c2s.tokens; tokens != 900 {
+		t.Errorf("ip bucket: tokens=%v, want=900", tokens)
+	}
+
+	// rate of target overrides default, case insensitive
+	fast := &throttler{tag: "c2s", target: "Fast", ip: &ipBuckets{}}
+	start = time.Now()
+	fast.wait(1000, make(chan struct{}))
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("fast target is throttled: %v", d)
+	}
+}
@@ -0,0 +1,699 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/ejoy/goscon/scp"
+	"github.com/ejoy/goscon/upstream"
+	"github.com/xjdrew/glog"
+)
+
+// fd of unix socket to old process, set when started by upgrade
+const upgradeEnv = "GOSCON_UPGRADE_FD"
+
+const (
+	handoffReadyTimeout = 30 * time.Second    // wait for new process to listen
+	handoffPairTimeout  = 3 * maxThrottleWait // wait for a pair to suspend, longer than a throttled write
+	handoffTimeout      = 60 * time.Second    // wait for all pairs to be handed over
+	resumeConcurrency   = 16                  // pairs restored at the same time
+)
+
+// type of handoff message
+const (
+	handoffListener    = "listener"
+	handoffListenerEnd = "listener_end"
+	handoffReady       = "ready"
+	handoffSession     = "session"
+	handoffDone        = "done"
+)
+
+var (
+	errHandoffMessage = errors.New("unexpected handoff message")
+	errHandoffFile    = errors.New("handoff file missing")
+	errPairClosed     = errors.New("pair closed")
+	errPairSuspend    = errors.New("pair suspend timeout")
+	errResuming       = errors.New("resuming sessions from old process")
+)
+
+type handoffListenerInfo struct {
+	Network string `json:"network"` // tcp, kcp or manager
+	Addr    string `json:"addr"`    // address in config
+}
+
+// handoffSessionInfo is state of a pair. Fds of client and upstream follow the message if exist.
+type handoffSessionInfo struct {
+	Client           *scp.State `json:"client"`
+	ClientNetwork    string     `json:"client_network"`
+	ClientLocalAddr  string     `json:"client_local_addr"`
+	ClientRemoteAddr string     `json:"client_remote_addr"`
+	ClientFile       bool       `json:"client_file"` // false if client is kcp or waiting for reuse
+
+	Upstream           *scp.State `json:"upstream"` // nil if upstream is not scp
+	UpstreamLocalAddr  string     `json:"upstream_local_addr"`
+	UpstreamRemoteAddr string     `json:"upstream_remote_addr"`
+	UpstreamFile       bool       `json:"upstream_file"`
+
+	HostName string `json:"host_name"`
+	HostAddr string `json:"host_addr"`
+
+	PendingC2S []byte `json:"pending_c2s"`
+	PendingS2C []byte `json:"pending_s2c"`
+
+	CreatedAt   time.Time `json:"created_at"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Reuses      int64     `json:"reuses"`
+	ClientIPs   []string  `json:"client_ips"`
+}
+
+type handoffMessage struct {
+	Type     string               `json:"type"`
+	Listener *handoffListenerInfo `json:"listener,omitempty"`
+	Session  *handoffSessionInfo  `json:"session,omitempty"`
+	IDs      []int                `json:"ids,omitempty"`     // ids in use, sent with listener_end
+	LateID   int                  `json:"late_id,omitempty"` // start of ids of sessions in handshake, sent with listener_end
+	Files    int                  `json:"files"`
+}
+
+// handoffConn transfers messages with fds between old and new process
+type handoffConn struct {
+	*net.UnixConn
+}
+
+func (c handoffConn) send(msg *handoffMessage, files ...*os.File) error {
+	msg.Files = len(files)
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	if _, err = c.Write(buf); err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	// fds are sent with a single byte, f.Fd() is not used as it sets fd to blocking mode
+	fds := make([]int, len(files))
+	for i, f := range files {
+		rc, err := f.SyscallConn()
+		if err != nil {
+			return err
+		}
+		rc.Control(func(fd uintptr) {
+			fds[i] = int(fd)
+		})
+	}
+	_, _, err = c.WriteMsgUnix([]byte{0}, syscall.UnixRights(fds...), nil)
+	return err
+}
+
+func (c handoffConn) recv() (*handoffMessage, []*os.File, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c, header[:]); err != nil {
+		return nil, nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(c, data); err != nil {
+		return nil, nil, err
+	}
+	var msg handoffMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, nil, err
+	}
+	if msg.Files == 0 {
+		return &msg, nil, nil
+	}
+
+	var b [1]byte
+	oob := make([]byte, syscall.CmsgSpace(4*msg.Files))
+	_, oobn, _, _, err := c.ReadMsgUnix(b[:], oob)
+	if err != nil {
+		return nil, nil, err
+	}
+	scms, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, nil, err
+	}
+	var files []*os.File
+	for _, scm := range scms {
+		fds, err := syscall.ParseUnixRights(&scm)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), "handoff"))
+		}
+	}
+	if len(files) != msg.Files {
+		closeFiles(files)
+		return nil, nil, errHandoffFile
+	}
+	return &msg, files, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// connFile returns a dup of fd of conn, nil if conn has no fd
+func connFile(conn net.Conn) *os.File {
+	if c, ok := conn.(tcpConn); ok {
+		conn = c.TCPConn
+	}
+	c, ok := conn.(filer)
+	if !ok {
+		return nil
+	}
+	f, err := c.File()
+	if err != nil {
+		return nil
+	}
+	return f
+}
+
+// handoffAddr is address of a conn restored without fd
+type handoffAddr struct {
+	network string
+	addr    string
+}
+
+func (a handoffAddr) Network() string { return a.network }
+func (a handoffAddr) String() string  { return a.addr }
+
+// closedConn stands for a conn waiting for reuse
+type closedConn struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (c *closedConn) Read(b []byte) (int, error)         { return 0, io.ErrClosedPipe }
+func (c *closedConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c *closedConn) Close() error                       { return nil }
+func (c *closedConn) LocalAddr() net.Addr                { return c.localAddr }
+func (c *closedConn) RemoteAddr() net.Addr               { return c.remoteAddr }
+func (c *closedConn) SetDeadline(t time.Time) error      { return nil }
+func (c *closedConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *closedConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func newClosedConn(network, laddr, raddr string) net.Conn {
+	return &closedConn{
+		localAddr:  handoffAddr{network, laddr},
+		remoteAddr: handoffAddr{network, raddr},
+	}
+}
+
+// notifyUpgrade returns the channel of upgrade signal
+func notifyUpgrade() <-chan os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+	return ch
+}
+
+func suspendConn(conn net.Conn, force bool) {
+	if c, ok := conn.(*LocalSCPConn); ok {
+		c.Suspend(force)
+		return
+	}
+	if force {
+		conn.SetDeadline(time.Now())
+	} else {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+// suspend stops pumps of pair without closing conns, and returns results of pumps.
+// Deadlines are set repeatedly as Read of client conn may reset read deadline.
+func (p *connPair) suspend() ([]*pumpResult, error) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	timer := time.NewTimer(handoffPairTimeout)
+	defer timer.Stop()
+
+	for i := 0; ; i++ {
+		// interrupt blocking write after a while
+		force := i >= 10
+		p.RemoteConn.Suspend(force)
+		suspendConn(p.LocalConn, force)
+		select {
+		case results := <-p.suspended:
+			if results == nil {
+				return nil, errPairClosed
+			}
+			return results, nil
+		case <-ticker.C:
+		case <-timer.C:
+			p.RemoteConn.Close()
+			p.LocalConn.Close()
+			return nil, errPairSuspend
+		}
+	}
+}
+
+func (ss *SCPServer) handoffPair(conn handoffConn, p *connPair) error {
+	results, err := p.suspend()
+	if err != nil {
+		return err
+	}
+	defer p.LocalConn.Close()
+	defer p.RemoteConn.Close()
+
+	var files []*os.File
+	defer func() {
+		closeFiles(files)
+	}()
+
+	session := &handoffSessionInfo{
+		PendingC2S:  results[0].pending,
+		PendingS2C:  results[1].pending,
+		CreatedAt:   p.createdAt,
+		ConnectedAt: p.connectedAt,
+		Reuses:      atomic.LoadInt64(&p.reuses),
+	}
+	if p.Host != nil {
+		session.HostName = p.Host.Name
+		session.HostAddr = p.Host.Addr
+	}
+	p.mutex.Lock()
+	session.ClientIPs = append(session.ClientIPs, p.clientIPs...)
+	p.mutex.Unlock()
+
+	if session.Client, err = p.RemoteConn.State(); err != nil {
+		return err
+	}
+	raw := p.RemoteConn.RawConn()
+	session.ClientNetwork = raw.LocalAddr().Network()
+	session.ClientLocalAddr = raw.LocalAddr().String()
+	session.ClientRemoteAddr = raw.RemoteAddr().String()
+	if !p.RemoteConn.Frozen() {
+		if f := connFile(raw); f != nil {
+			files = append(files, f)
+			session.ClientFile = true
+		}
+	}
+
+	local := p.LocalConn
+	if c, ok := local.(*LocalSCPConn); ok {
+		if session.Upstream, err = c.State(); err != nil {
+			return err
+		}
+		local = c.RawConn()
+	}
+	session.UpstreamLocalAddr = local.LocalAddr().String()
+	session.UpstreamRemoteAddr = local.RemoteAddr().String()
+	if c, ok := p.LocalConn.(*LocalSCPConn); !ok || !c.Frozen() {
+		if f := connFile(local); f != nil {
+			files = append(files, f)
+			session.UpstreamFile = true
+		}
+	}
+	if session.Upstream == nil && !session.UpstreamFile {
+		return errHandoffFile
+	}
+
+	return conn.send(&handoffMessage{Type: handoffSession, Session: session}, files...)
+}
+
+// handoffPairs hands over all pairs, pairs failed are closed
+func (ss *SCPServer) handoffPairs(conn handoffConn) (n int, err error) {
+	deadline := time.Now().Add(handoffTimeout)
+	for time.Now().Before(deadline) {
+		ss.connPairMutex.Lock()
+		pairs := make([]*connPair, 0, len(ss.connPairs))
+		for _, pair := range ss.connPairs {
+			pairs = append(pairs, pair)
+		}
+		ss.connPairMutex.Unlock()
+		if len(pairs) == 0 {
+			return
+		}
+
+		for _, pair := range pairs {
+			// skip pairs connecting to upstream, or already handed over
+			if !atomic.CompareAndSwapInt32(&pair.state, pairPumping, pairSuspending) {
+				continue
+			}
+			id := pair.RemoteConn.ID()
+			if err = ss.handoffPair(conn, pair); err != nil {
+				glog.Errorf("pair handoff failed: id=%d, err=%s", id, err.Error())
+				if err == errPairClosed || err == errPairSuspend {
+					err = nil
+					continue
+				}
+				// handoff conn is broken
+				ss.closeAllPairs()
+				return
+			}
+			n++
+			if glog.V(1) {
+				glog.Infof("pair handoff: id=%d", id)
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	glog.Errorf("handoff timeout, close pairs: pairs=%d", ss.pairCount())
+	ss.closeAllPairs()
+	return
+}
+
+// stopListeners closes all listeners, including kcp listeners
+func (ss *SCPServer) stopListeners() {
+	ss.listenerMutex.Lock()
+	defer ss.listenerMutex.Unlock()
+	for _, l := range ss.listeners {
+		l.Close()
+	}
+	if managerListener != nil {
+		managerListener.Close()
+	}
+}
+
+func (ss *SCPServer) sendListeners(conn handoffConn) error {
+	ss.listenerMutex.Lock()
+	defer ss.listenerMutex.Unlock()
+
+	send := func(network, addr string, l filer) error {
+		f, err := l.File()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return conn.send(&handoffMessage{
+			Type:     handoffListener,
+			Listener: &handoffListenerInfo{Network: network, Addr: addr},
+		}, f)
+	}
+
+	for _, l := range ss.listeners {
+		var err error
+		switch l := l.(type) {
+		case *TCPListener:
+			err = send("tcp", l.laddr, l.Listener.(filer))
+		case *KCPListener:
+			err = send("kcp", l.laddr, l.conn.(filer))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if managerListener != nil {
+		if err := send("manager", managerAddr, managerListener.(filer)); err != nil {
+			return err
+		}
+	}
+	// new process reserves ids before serving
+	ids, lateID := ss.freezeIDs()
+	return conn.send(&handoffMessage{Type: handoffListenerEnd, IDs: ids, LateID: lateID})
+}
+
+// upgrade starts a new process of current executable, and hands over listeners and pairs to it.
+// It reports whether the new process has taken over, then current process should exit even if err != nil.
+func upgrade() (bool, error) {
+	if atomic.LoadInt32(&resuming) == 1 {
+		return false, errResuming
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return false, err
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return false, err
+	}
+	local := os.NewFile(uintptr(fds[0]), "handoff")
+	remote := os.NewFile(uintptr(fds[1]), "handoff")
+	defer remote.Close()
+	c, err := net.FileConn(local)
+	local.Close()
+	if err != nil {
+		return false, err
+	}
+	conn := handoffConn{c.(*net.UnixConn)}
+	defer conn.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{remote} // fd 3
+	cmd.Env = append(os.Environ(), upgradeEnv+"=3")
+	if err = cmd.Start(); err != nil {
+		return false, err
+	}
+	glog.Infof("upgrade start: pid=%d", cmd.Process.Pid)
+
+	// wait for new process to serve
+	conn.SetReadDeadline(time.Now().Add(handoffReadyTimeout))
+	var msg *handoffMessage
+	if err = defaultServer.sendListeners(conn); err == nil {
+		if msg, _, err = conn.recv(); err == nil && msg.Type != handoffReady {
+			err = errHandoffMessage
+		}
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		defaultServer.unfreezeIDs()
+		return false, err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// new process is serving, no way back
+	defaultServer.stopListeners()
+	n, err := defaultServer.handoffPairs(conn)
+	if err == nil {
+		err = conn.send(&handoffMessage{Type: handoffDone})
+	}
+	glog.Infof("upgrade finished: pid=%d, pairs=%d", cmd.Process.Pid, n)
+	return true, err
+}
+
+var (
+	upgradeConn *handoffConn          // conn to old process
+	inherited   map[string][]*os.File // listener fds from old process
+	resuming    int32                 // atomic, 1 while resuming sessions, upgrade is refused
+)
+
+// inheritListeners receives listeners from old process if started by upgrade
+func inheritListeners() error {
+	s := os.Getenv(upgradeEnv)
+	if s == "" {
+		return nil
+	}
+	os.Unsetenv(upgradeEnv)
+
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), "handoff")
+	c, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	conn := handoffConn{c.(*net.UnixConn)}
+
+	inherited = make(map[string][]*os.File)
+	for {
+		msg, files, err := conn.recv()
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		if msg.Type == handoffListenerEnd {
+			defaultServer.reserveHandoffIDs(msg.IDs, msg.LateID)
+			break
+		}
+		if msg.Type != handoffListener || msg.Listener == nil || len(files) != 1 {
+			closeFiles(files)
+			conn.Close()
+			return errHandoffMessage
+		}
+		key := msg.Listener.Network + "|" + msg.Listener.Addr
+		inherited[key] = append(inherited[key], files[0])
+	}
+	upgradeConn = &conn
+	atomic.StoreInt32(&resuming, 1)
+	glog.Infof("inherit listeners from old process")
+	return nil
+}
+
+// inheritedFile returns a listener fd from old process, nil if not exists
+func inheritedFile(network string, laddr string) *os.File {
+	key := network + "|" + laddr
+	files := inherited[key]
+	if len(files) == 0 {
+		return nil
+	}
+	inherited[key] = files[1:]
+	return files[0]
+}
+
+func (ss *SCPServer) restorePair(session *handoffSessionInfo, files []*os.File) (err error) {
+	defer func() {
+		closeFiles(files)
+	}()
+
+	next := func() (net.Conn, error) {
+		if len(files) == 0 {
+			return nil, errHandoffFile
+		}
+		f := files[0]
+		files = files[1:]
+		defer f.Close()
+		return net.FileConn(f)
+	}
+
+	var clientConn net.Conn
+	if session.ClientFile {
+		c, err := next()
+		if err != nil {
+			return err
+		}
+		clientConn = newTCPConn(c.(*net.TCPConn))
+	} else {
+		clientConn = newClosedConn(session.ClientNetwork, session.ClientLocalAddr, session.ClientRemoteAddr)
+	}
+
+	var localConn net.Conn
+	if session.UpstreamFile {
+		if localConn, err = next(); err != nil {
+			clientConn.Close()
+			return err
+		}
+	} else {
+		localConn = newClosedConn("tcp", session.UpstreamLocalAddr, session.UpstreamRemoteAddr)
+	}
+
+	id := session.Client.ID
+	if !ss.acquireHandoffID(id) {
+		clientConn.Close()
+		localConn.Close()
+		return errHandoffMessage
+	}
+	restored := false
+	defer func() {
+		ss.endHandoffID(id, restored)
+	}()
+
+	scon := scp.Restore(clientConn, &scp.Config{ScpServer: ss}, session.Client)
+	remoteConn := NewSCPConn(scon)
+	if !session.ClientFile {
+		// wait for client to reuse
+		scon.Freeze()
+		remoteConn.setConnError(scon, io.ErrClosedPipe)
+	}
+
+	if session.Upstream != nil {
+		uscon := scp.Restore(localConn, &scp.Config{}, session.Upstream)
+		local := NewLocalSCPConn(uscon)
+		if !session.UpstreamFile {
+			uscon.Freeze()
+			local.setConnError(uscon, io.ErrClosedPipe)
+			go local.reuseConn()
+		}
+		localConn = local
+	}
+
+	pair := &connPair{
+		LocalConn:   localConn,
+		RemoteConn:  remoteConn,
+		Host:        upstream.AttachHost(session.HostName, session.HostAddr),
+		pendingC2S:  session.PendingC2S,
+		pendingS2C:  session.PendingS2C,
+		createdAt:   session.CreatedAt,
+		connectedAt: session.ConnectedAt,
+		reuses:      session.Reuses,
+		clientIPs:   session.ClientIPs,
+	}
+	pair.limitKey = defaultLimiter.addSession(remoteConn.RemoteAddr())
+	ss.addConnPair(id, pair)
+	restored = true
+	go func() {
+		defer ss.ReleaseID(id)
+		defer ss.removeConnPair(id)
+		pair.Pump()
+	}()
+	return nil
+}
+
+// resumeSessions tells old process to hand over pairs and restores them concurrently
+func resumeSessions() {
+	if upgradeConn == nil {
+		return
+	}
+	conn := *upgradeConn
+	upgradeConn = nil
+	defer conn.Close()
+	defer atomic.StoreInt32(&resuming, 0)
+	defer defaultServer.releaseHandoffIDs()
+
+	// listeners not used any more
+	for _, files := range inherited {
+		closeFiles(files)
+	}
+	inherited = nil
+
+	if err := conn.send(&handoffMessage{Type: handoffReady}); err != nil {
+		glog.Errorf("resume sessions failed: err=%s", err.Error())
+		return
+	}
+
+	var n int64
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, resumeConcurrency)
+	for {
+		msg, files, err := conn.recv()
+		if err != nil {
+			glog.Errorf("resume sessions failed: err=%s", err.Error())
+			break
+		}
+		if msg.Type == handoffDone {
+			break
+		}
+		if msg.Type != handoffSession || msg.Session == nil || msg.Session.Client == nil {
+			closeFiles(files)
+			glog.Errorf("resume sessions failed: err=%s", errHandoffMessage.Error())
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(session *handoffSessionInfo, files []*os.File) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := defaultServer.restorePair(session, files); err != nil {
+				glog.Errorf("pair resume failed: id=%d, err=%s", session.Client.ID, err.Error())
+				return
+			}
+			atomic.AddInt64(&n, 1)
+		}(msg.Session, files)
+	}
+	wg.Wait()
+	glog.Infof("resume sessions: pairs=%d", n)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errUpgradeNotSupported = errors.New("upgrade is not supported")
+
+// notifyUpgrade returns nil, as upgrade is not supported
+func notifyUpgrade() <-chan os.Signal {
+	return nil
+}
+
+func upgrade() (bool, error) {
+	return false, errUpgradeNotSupported
+}
+
+func inheritListeners() error {
+	return nil
+}
+
+func inheritedFile(network string, laddr string) *os.File {
+	return nil
+}
+
+func resumeSessions() {
+}
@@ -0,0 +1,219 @@
+package upstream
+
+import (
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/ejoy/goscon/scp"
+)
+
+// balance strategies of host group
+const (
+	BalanceRandom     = "random"      // random by weight, default
+	BalanceLeastConn  = "least_conn"  // least live pairs by weight
+	BalanceRoundRobin = "round_robin" // round robin, weight is ignored
+	BalanceHash       = "hash"        // consistent hashing by hash key
+)
+
+// hash keys of consistent hashing
+const (
+	HashKeyClientIP     = "client_ip"
+	HashKeyTargetServer = "target_server"
+	HashKeyHandshake    = "handshake" // hash key sent by client in handshake, client ip if absent
+)
+
+var (
+	errUnknownBalance = errors.New("unknown balance")
+	errUnknownHashKey = errors.New("unknown hash key")
+)
+
+func validateBalance(balance, hashKey string) error {
+	switch balance {
+	case "", BalanceRandom, BalanceLeastConn, BalanceRoundRobin:
+		return nil
+	case BalanceHash:
+		switch hashKey {
+		case "", HashKeyClientIP, HashKeyTargetServer, HashKeyHandshake:
+			return nil
+		}
+		return errUnknownHashKey
+	}
+	return errUnknownBalance
+}
+
+type ringNode struct {
+	hash uint32
+	host *Host
+}
+
+type hostGroup struct {
+	hosts []*Host
+
+	balance string
+	hashKey string
+
+	next uint64     // atomic, for round robin
+	ring []ringNode // for consistent hashing
+}
+
+func newHostGroup(balance, hashKey string) *hostGroup {
+	return &hostGroup{
+		balance: balance,
+		hashKey: hashKey,
+	}
+}
+
+// buildRing builds consistent hashing ring, each host has virtual nodes as many as its weight
+func (g *hostGroup) buildRing() {
+	if g.balance != BalanceHash {
+		return
+	}
+	g.ring = g.ring[:0]
+	for _, h := range g.hosts {
+		for i := 0; i < h.Weight; i++ {
+			g.ring = append(g.ring, ringNode{
+				hash: crc32.ChecksumIEEE([]byte(h.key() + "#" + strconv.Itoa(i))),
+				host: h,
+			})
+		}
+	}
+	sort.Slice(g.ring, func(i, j int) bool {
+		return g.ring[i].hash < g.ring[j].hash
+	})
+}
+
+func (g *hostGroup) hashKeyOf(remote *scp.Conn) (string, bool) {
+	if remote == nil {
+		return "", false
+	}
+	switch g.hashKey {
+	case HashKeyTargetServer:
+		return remote.TargetServer(), true
+	case HashKeyHandshake:
+		if key := remote.HashKey(); key != "" {
+			return key, true
+		}
+		fallthrough
+	default:
+		host, _, err := net.SplitHostPort(remote.RemoteAddr().String())
+		if err != nil {
+			return "", false
+		}
+		return host, true
+	}
+}
+
+func candidate(h *Host, tried map[string]bool) bool {
+	return h.available() && !tried[h.key()]
+}
+
+// chooseByLocalHosts chooses an available host by balance strategy of group, skips tried hosts
+func chooseByLocalHosts(group *hostGroup, remote *scp.Conn, tried map[string]bool) *Host {
+	if group == nil || len(group.hosts) == 0 {
+		return nil
+	}
+
+	switch group.balance {
+	case BalanceLeastConn:
+		return chooseByLeastConn(group, tried)
+	case BalanceRoundRobin:
+		return chooseByRoundRobin(group, tried)
+	case BalanceHash:
+		if key, ok := group.hashKeyOf(remote); ok {
+			return chooseByHash(group, key, tried)
+		}
+	}
+	return chooseByWeight(group, tried)
+}
+
+// chooseByWeight chooses an available host randomly by weight
+func chooseByWeight(group *hostGroup, tried map[string]bool) *Host {
+	weights := make([]int, len(group.hosts))
+	weight := 0
+	for i, host := range group.hosts {
+		if candidate(host, tried) {
+			weights[i] = host.weight()
+			weight += weights[i]
+		}
+	}
+	if weight == 0 {
+		return nil
+	}
+
+	v := rand.Intn(weight)
+	for i, host := range group.hosts {
+		if v < weights[i] {
+			return host
+		}
+		v -= weights[i]
+	}
+	return nil
+}
+
+// chooseByLeastConn chooses the host with least pairs per weight, breaks ties randomly
+func chooseByLeastConn(group *hostGroup, tried map[string]bool) *Host {
+	var best *Host
+	var bestPairs, bestWeight int64
+	ties := 0
+	for _, host := range group.hosts {
+		if !candidate(host, tried) {
+			continue
+		}
+		pairs := host.Pairs()
+		weight := int64(host.weight())
+		if best != nil {
+			// compare pairs/weight without division
+			d := pairs*bestWeight - bestPairs*weight
+			if d > 0 {
+				continue
+			}
+			if d == 0 {
+				ties++
+				if rand.Intn(ties+1) != 0 {
+					continue
+				}
+			} else {
+				ties = 0
+			}
+		}
+		best, bestPairs, bestWeight = host, pairs, weight
+	}
+	return best
+}
+
+// chooseByRoundRobin chooses the next available host in turn
+func chooseByRoundRobin(group *hostGroup, tried map[string]bool) *Host {
+	n := uint64(len(group.hosts))
+	start := atomic.AddUint64(&group.next, 1)
+	for i := uint64(0); i < n; i++ {
+		host := group.hosts[(start+i)%n]
+		if candidate(host, tried) {
+			return host
+		}
+	}
+	return nil
+}
+
+// chooseByHash chooses the first available host clockwise from hash of key on the ring
+func chooseByHash(group *hostGroup, key string, tried map[string]bool) *Host {
+	n := len(group.ring)
+	if n == 0 {
+		return nil
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(n, func(i int) bool {
+		return group.ring[i].hash >= hash
+	})
+	for i := 0; i < n; i++ {
+		host := group.ring[(start+i)%n].host
+		if candidate(host, tried) {
+			return host
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package upstream
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/ejoy/goscon/scp"
+)
+
+func testHostGroup(balance string, n int) *hostGroup {
+	group := newHostGroup(balance, "")
+	for i := 0; i < n; i++ {
+		h := &Host{
+			Name:   "test",
+			Addr:   "127.0.0.1:" + strconv.Itoa(10000+i),
+			Weight: defaultWeight,
+		}
+		h.state = newHostState(h.Name, h.Addr)
+		group.hosts = append(group.hosts, h)
+	}
+	group.buildRing()
+	return group
+}
+
+func TestChooseByHash(t *testing.T) {
+	group := testHostGroup(BalanceHash, 5)
+
+	for i := 0; i < 100; i++ {
+		key := "10.0.0." + strconv.Itoa(i)
+		h := chooseByHash(group, key, nil)
+		if h == nil {
+			t.Fatalf("no host for key %s", key)
+		}
+		if chooseByHash(group, key, nil) != h {
+			t.Errorf("key %s: not consistent", key)
+		}
+
+		tried := map[string]bool{h.key(): true}
+		next := chooseByHash(group, key, tried)
+		if next == nil || next == h {
+			t.Errorf("key %s: failover to tried host", key)
+		}
+
+		// keys not on the ejected host keep their hosts
+		other := group.hosts[0]
+		if h != other && chooseByHash(group, key, map[string]bool{other.key(): true}) != h {
+			t.Errorf("key %s: moved when another host removed", key)
+		}
+	}
+}
+
+func TestChooseByLeastConn(t *testing.T) {
+	group := testHostGroup(BalanceLeastConn, 3)
+	group.hosts[0].state.pairs = 3
+	group.hosts[1].state.pairs = 1
+	group.hosts[2].state.pairs = 2
+
+	if h := chooseByLeastConn(group, nil); h != group.hosts[1] {
+		t.Errorf("least conn: %v", h)
+	}
+
+	tried := map[string]bool{group.hosts[1].key(): true}
+	if h := chooseByLeastConn(group, tried); h != group.hosts[2] {
+		t.Errorf("least conn with tried: %v", h)
+	}
+}
+
+func TestChooseByRoundRobin(t *testing.T) {
+	group := testHostGroup(BalanceRoundRobin, 3)
+	group.hosts[1].state.healthy = 0
+
+	counts := make(map[*Host]int)
+	for i := 0; i < 30; i++ {
+		counts[chooseByRoundRobin(group, nil)]++
+	}
+	if counts[group.hosts[1]] != 0 {
+		t.Errorf("round robin chooses unhealthy host")
+	}
+	if counts[group.hosts[0]] == 0 || counts[group.hosts[2]] == 0 {
+		t.Errorf("round robin: %v", counts)
+	}
+}
+
+func TestHashKeyHandshake(t *testing.T) {
+	group := testHostGroup(BalanceHash, 5)
+	group.hashKey = HashKeyHandshake
+
+	hostOf := func(group *hostGroup, key string) *Host {
+		c, _ := net.Pipe()
+		defer c.Close()
+		remote := scp.Restore(c, &scp.Config{}, &scp.State{HashKey: key})
+		k, ok := group.hashKeyOf(remote)
+		if !ok || k != key {
+			t.Fatalf("hash key of handshake: %q %v", k, ok)
+		}
+		return chooseByHash(group, k, nil)
+	}
+
+	keys := make(map[string]*Host)
+	for i := 0; i < 100; i++ {
+		key := "player" + strconv.Itoa(i)
+		keys[key] = hostOf(group, key)
+	}
+
+	// host added, keys move to the new host only
+	added := &Host{Name: "test", Addr: "127.0.0.1:20000", Weight: defaultWeight}
+	added.state = newHostState(added.Name, added.Addr)
+	group.hosts = append(group.hosts, added)
+	group.buildRing()
+	moved := 0
+	for key, h := range keys {
+		switch hostOf(group, key) {
+		case h:
+		case added:
+			moved++
+		default:
+			t.Errorf("key %s: moved to an old host when host added", key)
+		}
+	}
+	if moved == 0 || moved == len(keys) {
+		t.Errorf("keys moved to added host: %d", moved)
+	}
+
+	// hosts removed, keys on other hosts stay
+	removed := group.hosts[4]
+	group.hosts = group.hosts[:4]
+	group.buildRing()
+	for key, h := range keys {
+		if h != removed && hostOf(group, key) != h {
+			t.Errorf("key %s: moved when another host removed", key)
+		}
+	}
+}
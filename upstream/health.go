@@ -0,0 +1,197 @@
+package upstream
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ejoy/goscon/scp"
+	"github.com/xjdrew/glog"
+)
+
+// HealthCheck describes active health check of hosts
+type HealthCheck struct {
+	Interval int // seconds between two checks, default 5s
+	Timeout  int // seconds to wait for a check, default 2s
+	Rise     int // consecutive successes to mark host healthy, default 2
+	Fall     int // consecutive failures to mark host unhealthy, default 3
+}
+
+func (hc *HealthCheck) interval() time.Duration {
+	if hc.Interval <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(hc.Interval) * time.Second
+}
+
+func (hc *HealthCheck) timeout() time.Duration {
+	if hc.Timeout <= 0 {
+		return 2 * time.Second
+	}
+	return time.Duration(hc.Timeout) * time.Second
+}
+
+func (hc *HealthCheck) rise() int {
+	if hc.Rise <= 0 {
+		return 2
+	}
+	return hc.Rise
+}
+
+func (hc *HealthCheck) fall() int {
+	if hc.Fall <= 0 {
+		return 3
+	}
+	return hc.Fall
+}
+
+// hostState holds runtime state of a host
+type hostState struct {
+	name string
+	addr string
+
+	healthy int32 // atomic, 1 means healthy
+	pairs   int64 // atomic, live pairs connected to host
+
+	mu        sync.Mutex
+	successes int           // consecutive successful checks
+	failures  int           // consecutive failed checks
+	checkDone chan struct{} // close to stop health check
+	removed   bool          // host is removed
+
+	outlierState
+}
+
+func newHostState(name, addr string) *hostState {
+	return &hostState{
+		name:    name,
+		addr:    addr,
+		healthy: 1,
+	}
+}
+
+func (st *hostState) isHealthy() bool {
+	return atomic.LoadInt32(&st.healthy) == 1
+}
+
+func (st *hostState) setHealthy(healthy bool) {
+	var v int32
+	if healthy {
+		v = 1
+	}
+	atomic.StoreInt32(&st.healthy, v)
+	hostHealthy.WithLabelValues(st.name, st.addr).Set(float64(v))
+}
+
+var errNoAddr = errors.New("no addr")
+
+// onCheck updates health by result of a check
+func (st *hostState) onCheck(hc *HealthCheck, done chan struct{}, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	// health check has been stopped or restarted
+	if st.checkDone != done {
+		return
+	}
+
+	if err == nil {
+		st.failures = 0
+		st.successes++
+		if !st.isHealthy() && st.successes >= hc.rise() {
+			st.setHealthy(true)
+			glog.Infof("upstream host healthy: name=%s, addr=%s", st.name, st.addr)
+		}
+		return
+	}
+
+	st.successes = 0
+	st.failures++
+	if glog.V(1) {
+		glog.Infof("upstream health check failed: name=%s, addr=%s, failures=%d, err=%s", st.name, st.addr, st.failures, err.Error())
+	}
+	if st.isHealthy() && st.failures >= hc.fall() {
+		st.setHealthy(false)
+		glog.Errorf("upstream host unhealthy: name=%s, addr=%s, err=%s", st.name, st.addr, err.Error())
+	}
+}
+
+func (st *hostState) stopHealthCheck() {
+	if st.checkDone != nil {
+		close(st.checkDone)
+		st.checkDone = nil
+	}
+}
+
+// startHealthCheck (re)starts health check of host, hc == nil disables health check
+func (st *hostState) startHealthCheck(h *Host, hc *HealthCheck, network string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.stopHealthCheck()
+	if hc == nil {
+		st.successes = 0
+		st.failures = 0
+		st.setHealthy(true)
+		return
+	}
+	st.setHealthy(st.isHealthy())
+
+	done := make(chan struct{})
+	st.checkDone = done
+	go func() {
+		ticker := time.NewTicker(hc.interval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				st.onCheck(hc, done, checkHost(h, network, hc.timeout()))
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// stop is called when host is removed
+func (st *hostState) stop() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.stopHealthCheck()
+	st.removed = true
+	hostHealthy.DeleteLabelValues(st.name, st.addr)
+	hostEjected.DeleteLabelValues(st.name, st.addr)
+}
+
+// checkHost connects to host, and finishes a scp handshake if network is scp
+func checkHost(h *Host, network string, timeout time.Duration) (err error) {
+	if len(h.addrs) == 0 {
+		return errNoAddr
+	}
+
+	var conn net.Conn
+	for _, addr := range h.addrs {
+		conn, err = net.DialTimeout("tcp", addr.String(), timeout)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if network == "scp" {
+		// scp handshake sets its own deadline, so close conn when timeout
+		timer := time.AfterFunc(timeout, func() { conn.Close() })
+		defer timer.Stop()
+
+		scon, _ := scp.Client(conn, &scp.Config{
+			Flag: scp.SCPFlagForbidForwardIP,
+		})
+		err = scon.Handshake()
+	}
+	return
+}
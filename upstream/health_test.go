@@ -0,0 +1,59 @@
+package upstream
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHealthCheckRiseFall(t *testing.T) {
+	hc := &HealthCheck{Rise: 2, Fall: 3}
+	st := newHostState("test", "127.0.0.1:10000")
+	done := make(chan struct{})
+	st.checkDone = done
+
+	errCheck := errors.New("check failed")
+	steps := []struct {
+		err     error
+		healthy bool
+	}{
+		{errCheck, true},
+		{errCheck, true},
+		{nil, true}, // success resets failures
+		{errCheck, true},
+		{errCheck, true},
+		{errCheck, false},
+		{errCheck, false},
+		{nil, false},
+		{errCheck, false}, // failure resets successes
+		{nil, false},
+		{nil, true},
+		{nil, true},
+	}
+	for i, step := range steps {
+		st.onCheck(hc, done, step.err)
+		if st.isHealthy() != step.healthy {
+			t.Fatalf("step %d: healthy=%v, want=%v", i, st.isHealthy(), step.healthy)
+		}
+	}
+}
+
+func TestHealthCheckStale(t *testing.T) {
+	hc := &HealthCheck{Fall: 1}
+	st := newHostState("test", "127.0.0.1:10000")
+	st.checkDone = make(chan struct{})
+
+	// result of a stopped check is ignored
+	st.onCheck(hc, make(chan struct{}), errors.New("check failed"))
+	if !st.isHealthy() {
+		t.Errorf("host marked unhealthy by stale check")
+	}
+}
+
+func TestHealthCheckDisable(t *testing.T) {
+	st := newHostState("test", "127.0.0.1:10000")
+	st.setHealthy(false)
+	st.startHealthCheck(&Host{Name: "test", Addr: "127.0.0.1:10000"}, nil, "tcp")
+	if !st.isHealthy() || st.checkDone != nil {
+		t.Errorf("host not healthy after health check disabled")
+	}
+}
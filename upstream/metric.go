@@ -0,0 +1,40 @@
+package upstream
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	hostHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "goscon_upstream_host_healthy",
+		Help: "health of upstream host, 1 for healthy and 0 for unhealthy",
+	}, []string{"name", "addr"})
+
+	hostEjected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "goscon_upstream_host_ejected",
+		Help: "whether upstream host is ejected by outlier detection",
+	}, []string{"name", "addr"})
+
+	hostEjections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goscon_upstream_host_ejections",
+		Help: "times of upstream host ejected by outlier detection, partitioned by host name",
+	}, []string{"name"})
+
+	dialAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goscon_upstream_dial_attempts",
+		Help: "number of attempts to connect to upstream host, partitioned by result",
+	}, []string{"result"})
+
+	dialRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "goscon_upstream_dial_retries",
+		Help: "times of retry another upstream host after failed",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(hostHealthy)
+	prometheus.MustRegister(hostEjected)
+	prometheus.MustRegister(hostEjections)
+	prometheus.MustRegister(dialAttempts)
+	prometheus.MustRegister(dialRetries)
+}
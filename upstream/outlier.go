@@ -0,0 +1,255 @@
+package upstream
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/xjdrew/glog"
+)
+
+// OutlierDetection describes passive outlier ejection of hosts.
+// Errors are dial failures, hook failures, and upstream closed soon after connected.
+type OutlierDetection struct {
+	Interval         int // seconds, window to count errors, default 10s
+	MinRequests      int `mapstructure:"min_requests"`       // min requests in window to judge a host, default 5
+	ErrorRate        int `mapstructure:"error_rate"`         // percent of errors to eject a host, default 50
+	ResetWindow      int `mapstructure:"reset_window"`       // seconds, upstream closed within it counts as an error, default 5s
+	BaseEjectionTime int `mapstructure:"base_ejection_time"` // seconds, doubled for each consecutive ejection, default 30s
+	MaxEjectionTime  int `mapstructure:"max_ejection_time"`  // seconds, default 300s
+	SlowStart        int `mapstructure:"slow_start"`         // seconds, weight ramps up after ejection, default 30s
+	// max percent of hosts can be ejected at the same time, default 50%
+	MaxEjectionPercent int `mapstructure:"max_ejection_percent"`
+}
+
+func seconds(v int, def time.Duration) time.Duration {
+	if v <= 0 {
+		return def
+	}
+	return time.Duration(v) * time.Second
+}
+
+func (od *OutlierDetection) interval() time.Duration {
+	return seconds(od.Interval, 10*time.Second)
+}
+
+func (od *OutlierDetection) minRequests() int {
+	if od.MinRequests <= 0 {
+		return 5
+	}
+	return od.MinRequests
+}
+
+func (od *OutlierDetection) errorRate() int {
+	if od.ErrorRate <= 0 {
+		return 50
+	}
+	return od.ErrorRate
+}
+
+func (od *OutlierDetection) resetWindow() time.Duration {
+	return seconds(od.ResetWindow, 5*time.Second)
+}
+
+func (od *OutlierDetection) baseEjectionTime() time.Duration {
+	return seconds(od.BaseEjectionTime, 30*time.Second)
+}
+
+func (od *OutlierDetection) maxEjectionTime() time.Duration {
+	return seconds(od.MaxEjectionTime, 300*time.Second)
+}
+
+func (od *OutlierDetection) slowStart() time.Duration {
+	return seconds(od.SlowStart, 30*time.Second)
+}
+
+func (od *OutlierDetection) maxEjectionPercent() int {
+	if od.MaxEjectionPercent <= 0 {
+		return 50
+	}
+	return od.MaxEjectionPercent
+}
+
+// Ejection describes an ejected host
+type Ejection struct {
+	Name      string    `json:"name"`
+	Addr      string    `json:"addr"`
+	Ejections int       `json:"ejections"` // consecutive ejections
+	Until     time.Time `json:"until"`
+	SlowStart time.Time `json:"slow_start_until"`
+}
+
+// outlierState is embedded in hostState, protected by hostState.mu except atomic fields
+type outlierState struct {
+	od    *OutlierDetection
+	peers *atomic.Value // []*hostState, all hosts of upstreams, to cap ejected hosts
+
+	windowStart time.Time
+	requests    int
+	errors      int
+	ejections   int
+
+	ejectedUntil   int64 // atomic, unix nano
+	slowStartUntil int64 // atomic, unix nano
+}
+
+func (st *hostState) setOutlierDetection(od *OutlierDetection, peers *atomic.Value) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.od = od
+	st.peers = peers
+}
+
+func (st *hostState) isEjected(now int64) bool {
+	return now < atomic.LoadInt64(&st.ejectedUntil)
+}
+
+// slowStartFactor returns percent of weight while host is in slow start
+func (st *hostState) slowStartFactor(now int64) int64 {
+	until := atomic.LoadInt64(&st.slowStartUntil)
+	if now >= until {
+		return 100
+	}
+	start := atomic.LoadInt64(&st.ejectedUntil)
+	if until <= start {
+		return 100
+	}
+	return (now - start) * 100 / (until - start)
+}
+
+// onRequest is called when a new connection to host is made
+func (st *hostState) onRequest(ok bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.od == nil {
+		return
+	}
+	st.rollWindow()
+	st.requests++
+	if !ok {
+		st.errors++
+		st.tryEject()
+	}
+}
+
+// onError is called when an established connection to host failed
+func (st *hostState) onError() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.od == nil {
+		return
+	}
+	st.addError()
+}
+
+// onClosed is called when an established connection is ended by upstream
+func (st *hostState) onClosed(lifetime time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.od == nil || lifetime >= st.od.resetWindow() {
+		return
+	}
+	st.addError()
+}
+
+func (st *hostState) addError() {
+	st.rollWindow()
+	st.errors++
+	if st.requests < st.errors {
+		st.requests = st.errors
+	}
+	st.tryEject()
+}
+
+func (st *hostState) rollWindow() {
+	now := time.Now()
+	if now.Sub(st.windowStart) > st.od.interval() {
+		st.windowStart = now
+		st.requests = 0
+		st.errors = 0
+	}
+}
+
+// allowEject reports whether one more host can be ejected without exceeding max_ejection_percent
+func (st *hostState) allowEject(now int64) bool {
+	if st.peers == nil {
+		return true
+	}
+	peers, _ := st.peers.Load().([]*hostState)
+	ejected := 0
+	for _, peer := range peers {
+		if peer.isEjected(now) {
+			ejected++
+		}
+	}
+	return (ejected+1)*100 <= len(peers)*st.od.maxEjectionPercent()
+}
+
+func (st *hostState) tryEject() {
+	od := st.od
+	now := time.Now()
+	if st.isEjected(now.UnixNano()) {
+		return
+	}
+	if st.requests < od.minRequests() || st.errors*100 < st.requests*od.errorRate() {
+		return
+	}
+	if !st.allowEject(now.UnixNano()) {
+		if glog.V(1) {
+			glog.Infof("upstream host ejection skipped: name=%s, addr=%s, requests=%d, errors=%d, reason=max_ejection_percent",
+				st.name, st.addr, st.requests, st.errors)
+		}
+		return
+	}
+
+	// host has been stable long enough, reset backoff
+	if now.Sub(time.Unix(0, atomic.LoadInt64(&st.ejectedUntil))) > od.maxEjectionTime() {
+		st.ejections = 0
+	}
+
+	d := od.baseEjectionTime()
+	for i := 0; i < st.ejections && d < od.maxEjectionTime(); i++ {
+		d *= 2
+	}
+	if d > od.maxEjectionTime() {
+		d = od.maxEjectionTime()
+	}
+	st.ejections++
+
+	until := now.Add(d)
+	atomic.StoreInt64(&st.ejectedUntil, until.UnixNano())
+	atomic.StoreInt64(&st.slowStartUntil, until.Add(od.slowStart()).UnixNano())
+
+	glog.Errorf("upstream host ejected: name=%s, addr=%s, requests=%d, errors=%d, ejections=%d, duration=%v",
+		st.name, st.addr, st.requests, st.errors, st.ejections, d)
+	st.requests = 0
+	st.errors = 0
+
+	hostEjections.WithLabelValues(st.name).Inc()
+	hostEjected.WithLabelValues(st.name, st.addr).Set(1)
+	time.AfterFunc(d, func() {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if st.removed || st.isEjected(time.Now().UnixNano()) {
+			return
+		}
+		hostEjected.WithLabelValues(st.name, st.addr).Set(0)
+		glog.Infof("upstream host returned: name=%s, addr=%s", st.name, st.addr)
+	})
+}
+
+func (st *hostState) ejection() *Ejection {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now().UnixNano()
+	slowStartUntil := atomic.LoadInt64(&st.slowStartUntil)
+	if now >= slowStartUntil {
+		return nil
+	}
+	return &Ejection{
+		Name:      st.name,
+		Addr:      st.addr,
+		Ejections: st.ejections,
+		Until:     time.Unix(0, atomic.LoadInt64(&st.ejectedUntil)),
+		SlowStart: time.Unix(0, slowStartUntil),
+	}
+}
@@ -0,0 +1,124 @@
+package upstream
+
+import (
+	"io"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func testOutlierStates(od *OutlierDetection, n int) []*hostState {
+	var peers atomic.Value
+	states := make([]*hostState, n)
+	for i := range states {
+		states[i] = newHostState("test", "127.0.0.1:"+strconv.Itoa(10000+i))
+		states[i].setOutlierDetection(od, &peers)
+	}
+	peers.Store(states)
+	return states
+}
+
+func TestOutlierEject(t *testing.T) {
+	od := &OutlierDetection{MinRequests: 4, ErrorRate: 50, MaxEjectionPercent: 100}
+	st := testOutlierStates(od, 1)[0]
+
+	st.onRequest(true)
+	st.onRequest(true)
+	st.onRequest(false)
+	if st.isEjected(time.Now().UnixNano()) {
+		t.Fatalf("ejected before min requests")
+	}
+	st.onRequest(false)
+	if !st.isEjected(time.Now().UnixNano()) {
+		t.Fatalf("not ejected at error rate")
+	}
+	if st.requests != 0 || st.errors != 0 {
+		t.Errorf("window not reset after ejection: requests=%d, errors=%d", st.requests, st.errors)
+	}
+	if e := st.ejection(); e == nil || e.Ejections != 1 {
+		t.Errorf("ejection: %+v", e)
+	}
+}
+
+func TestOutlierEjectionBackoff(t *testing.T) {
+	od := &OutlierDetection{MinRequests: 1, BaseEjectionTime: 10, MaxEjectionTime: 30, MaxEjectionPercent: 100}
+	st := testOutlierStates(od, 1)[0]
+
+	for i, want := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second} {
+		// end the previous ejection just now, so backoff isn't reset
+		atomic.StoreInt64(&st.ejectedUntil, time.Now().UnixNano())
+		st.onRequest(false)
+		d := time.Until(time.Unix(0, atomic.LoadInt64(&st.ejectedUntil)))
+		if d > want || d < want-time.Second {
+			t.Errorf("ejection %d: duration=%v, want=%v", i+1, d, want)
+		}
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	od := &OutlierDetection{MinRequests: 1, MaxEjectionPercent: 50}
+	states := testOutlierStates(od, 4)
+	for _, st := range states {
+		st.onRequest(false)
+	}
+
+	ejected := 0
+	now := time.Now().UnixNano()
+	for _, st := range states {
+		if st.isEjected(now) {
+			ejected++
+		}
+	}
+	if ejected != 2 {
+		t.Errorf("ejected=%d, want=2", ejected)
+	}
+
+	// a single host is never ejected by default
+	st := testOutlierStates(&OutlierDetection{MinRequests: 1}, 1)[0]
+	st.onRequest(false)
+	if st.isEjected(time.Now().UnixNano()) {
+		t.Errorf("the only host is ejected")
+	}
+}
+
+func TestOutlierClosed(t *testing.T) {
+	od := &OutlierDetection{MinRequests: 2, ResetWindow: 5, MaxEjectionPercent: 100}
+	st := testOutlierStates(od, 1)[0]
+
+	st.onRequest(true)
+	st.onRequest(true)
+	st.onClosed(10 * time.Second)
+	if st.errors != 0 {
+		t.Errorf("long lived conn counts as an error")
+	}
+	st.onClosed(time.Second)
+	if !st.isEjected(time.Now().UnixNano()) {
+		t.Errorf("not ejected by conns closed soon")
+	}
+}
+
+func TestHostRelease(t *testing.T) {
+	od := &OutlierDetection{MinRequests: 1, ResetWindow: 5, MaxEjectionPercent: 100}
+	cases := []struct {
+		err     error
+		ejected bool
+	}{
+		{nil, false},
+		{io.EOF, false},
+		{syscall.ECONNRESET, true},
+	}
+	for _, c := range cases {
+		h := &Host{Name: "test", Addr: "127.0.0.1:10000"}
+		h.state = testOutlierStates(od, 1)[0]
+		h.acquire()
+		h.Release(time.Second, c.err)
+		if ejected := h.state.isEjected(time.Now().UnixNano()); ejected != c.ejected {
+			t.Errorf("err=%v: ejected=%v", c.err, ejected)
+		}
+		if h.Pairs() != 0 {
+			t.Errorf("err=%v: pairs=%d", c.err, h.Pairs())
+		}
+	}
+}
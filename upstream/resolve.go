@@ -0,0 +1,184 @@
+package upstream
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/xjdrew/glog"
+)
+
+// reference to the host:port format of `net.Dial`.
+func lookupTCPAddrs(hostport string) ([]*net.TCPAddr, error) {
+	host, service, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(addrs)
+	tcpAddrs := make([]*net.TCPAddr, len(addrs))
+	for i, addr := range addrs {
+		addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(addr, service))
+		if err != nil { // only error when lookup port failed
+			return nil, err
+		}
+		tcpAddrs[i] = addr
+	}
+	return tcpAddrs, nil
+}
+
+// lookupSRVHosts expands host by srv records with the highest priority
+func lookupSRVHosts(host Host) ([]*Host, error) {
+	_, records, err := net.LookupSRV("", "", host.SRV)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make([]*Host, 0, len(records))
+	for _, record := range records {
+		// records are sorted by priority
+		if record.Priority != records[0].Priority {
+			break
+		}
+		hostport := net.JoinHostPort(record.Target, strconv.Itoa(int(record.Port)))
+		addrs, err := lookupTCPAddrs(hostport)
+		if err != nil {
+			return nil, err
+		}
+		h := host
+		h.Addr = hostport
+		h.Weight = int(record.Weight)
+		if h.Weight <= 0 {
+			h.Weight = host.Weight
+		}
+		if h.Weight <= 0 {
+			h.Weight = defaultWeight
+		}
+		h.addrs = addrs
+		hosts = append(hosts, &h)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Addr < hosts[j].Addr
+	})
+	return hosts, nil
+}
+
+// resolveHosts resolves addrs of hosts, and expands srv hosts. If last is not nil,
+// a host failed to resolve keeps its addrs in last, otherwise the error returns.
+func resolveHosts(hosts []Host, last []*Host) ([]*Host, error) {
+	resolved := make([]*Host, 0, len(hosts))
+	for _, host := range hosts {
+		if host.SRV != "" {
+			srvHosts, err := lookupSRVHosts(host)
+			if err != nil {
+				if last == nil {
+					return nil, err
+				}
+				glog.Errorf("resolve upstream srv failed, keep last hosts: name=%s, srv=%s, err=%s", host.Name, host.SRV, err.Error())
+				for _, h := range last {
+					if h.Name == host.Name && h.SRV == host.SRV {
+						srvHosts = append(srvHosts, h)
+					}
+				}
+			}
+			resolved = append(resolved, srvHosts...)
+			continue
+		}
+
+		h := host
+		if h.Weight <= 0 {
+			// set default weight
+			h.Weight = defaultWeight
+		}
+		addrs, err := lookupTCPAddrs(h.Addr)
+		if err != nil {
+			if last == nil {
+				return nil, err
+			}
+			glog.Errorf("resolve upstream failed, keep last addrs: name=%s, addr=%s, err=%s", h.Name, h.Addr, err.Error())
+			for _, old := range last {
+				if old.key() == h.key() {
+					addrs = old.addrs
+					break
+				}
+			}
+		}
+		h.addrs = addrs
+		resolved = append(resolved, &h)
+	}
+	return resolved, nil
+}
+
+func sameAddrs(a, b []*net.TCPAddr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+func hostsChanged(last, hosts []*Host) bool {
+	if len(last) != len(hosts) {
+		return true
+	}
+	for i := range hosts {
+		if last[i].key() != hosts[i].key() || last[i].Weight != hosts[i].Weight ||
+			!sameAddrs(last[i].addrs, hosts[i].addrs) {
+			return true
+		}
+	}
+	return false
+}
+
+// startRefresh (re)starts resolving hosts periodically, should hold stateMu
+func (u *upstreams) startRefresh(option *Option, table *routeTable, hosts []Host) {
+	if u.refreshDone != nil {
+		close(u.refreshDone)
+		u.refreshDone = nil
+	}
+
+	interval := option.resolveInterval()
+	if interval <= 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	u.refreshDone = done
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				u.refresh(option, table, hosts, done)
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+func (u *upstreams) refresh(option *Option, table *routeTable, hosts []Host, done chan struct{}) {
+	last := u.allHosts.Load().(*hostGroup).hosts
+	resolved, _ := resolveHosts(hosts, last)
+	if !hostsChanged(last, resolved) {
+		return
+	}
+
+	u.stateMu.Lock()
+	defer u.stateMu.Unlock()
+	// hosts are updated while resolving
+	if u.refreshDone != done {
+		return
+	}
+	u.applyHosts(option, table, resolved)
+	glog.Infof("upstream hosts re-resolved: hosts=%d", len(resolved))
+}
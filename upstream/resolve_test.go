@@ -0,0 +1,142 @@
+package upstream
+
+import (
+	"net"
+	"testing"
+)
+
+func testTCPAddrs(addrs ...string) []*net.TCPAddr {
+	tcpAddrs := make([]*net.TCPAddr, len(addrs))
+	for i, addr := range addrs {
+		tcpAddrs[i], _ = net.ResolveTCPAddr("tcp", addr)
+	}
+	return tcpAddrs
+}
+
+func TestHostsChanged(t *testing.T) {
+	host := func(name, addr string, weight int, addrs ...string) *Host {
+		return &Host{Name: name, Addr: addr, Weight: weight, addrs: testTCPAddrs(addrs...)}
+	}
+	last := []*Host{
+		host("s1", "a:1", 100, "10.0.0.1:1", "10.0.0.2:1"),
+		host("s2", "b:1", 100, "10.0.0.3:1"),
+	}
+	cases := []struct {
+		name    string
+		hosts   []*Host
+		changed bool
+	}{
+		{"same", []*Host{host("s1", "a:1", 100, "10.0.0.1:1", "10.0.0.2:1"), host("s2", "b:1", 100, "10.0.0.3:1")}, false},
+		{"addr added", []*Host{host("s1", "a:1", 100, "10.0.0.1:1", "10.0.0.2:1", "10.0.0.4:1"), host("s2", "b:1", 100, "10.0.0.3:1")}, true},
+		{"addr changed", []*Host{host("s1", "a:1", 100, "10.0.0.1:1", "10.0.0.2:1"), host("s2", "b:1", 100, "10.0.0.4:1")}, true},
+		{"weight changed", []*Host{host("s1", "a:1", 100, "10.0.0.1:1", "10.0.0.2:1"), host("s2", "b:1", 50, "10.0.0.3:1")}, true},
+		{"host removed", []*Host{host("s1", "a:1", 100, "10.0.0.1:1", "10.0.0.2:1")}, true},
+		{"host replaced", []*Host{host("s1", "a:1", 100, "10.0.0.1:1", "10.0.0.2:1"), host("s3", "b:1", 100, "10.0.0.3:1")}, true},
+	}
+	for _, c := range cases {
+		if changed := hostsChanged(last, c.hosts); changed != c.changed {
+			t.Errorf("%s: changed=%v", c.name, changed)
+		}
+	}
+}
+
+func TestResolveHosts(t *testing.T) {
+	last := []*Host{{Name: "bad", Addr: "bad.invalid:1", addrs: testTCPAddrs("10.0.0.1:1")}}
+	cases := []struct {
+		name   string
+		hosts  []Host
+		last   []*Host
+		ok     bool
+		addrs  []string // addrs of the first host
+		weight int      // weight of the first host
+	}{
+		{"ip", []Host{{Name: "s1", Addr: "127.0.0.1:1"}}, nil, true, []string{"127.0.0.1:1"}, defaultWeight},
+		{"weight", []Host{{Name: "s1", Addr: "127.0.0.1:1", Weight: 5}}, nil, true, []string{"127.0.0.1:1"}, 5},
+		{"name", []Host{{Name: "s1", Addr: "localhost:1"}}, nil, true, []string{"127.0.0.1:1"}, defaultWeight},
+		// failed to resolve on update
+		{"failed", []Host{{Name: "bad", Addr: "bad.invalid:1"}}, nil, false, nil, 0},
+		// failed to re-resolve, last addrs are kept
+		{"keep last", []Host{{Name: "bad", Addr: "bad.invalid:1"}}, last, true, []string{"10.0.0.1:1"}, defaultWeight},
+		{"not in last", []Host{{Name: "bad2", Addr: "bad.invalid:1"}}, last, true, nil, defaultWeight},
+	}
+	for _, c := range cases {
+		resolved, err := resolveHosts(c.hosts, c.last)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: err=%v", c.name, err)
+			continue
+		}
+		if !c.ok {
+			continue
+		}
+		if len(resolved) != len(c.hosts) {
+			t.Errorf("%s: resolved=%d hosts", c.name, len(resolved))
+			continue
+		}
+		h := resolved[0]
+		if h.Weight != c.weight {
+			t.Errorf("%s: weight=%d", c.name, h.Weight)
+		}
+		// localhost may have ipv6 addr too
+		found := 0
+		for _, addr := range h.addrs {
+			for _, want := range c.addrs {
+				if addr.String() == want {
+					found++
+				}
+			}
+		}
+		if found != len(c.addrs) || (c.addrs == nil && len(h.addrs) > 0) {
+			t.Errorf("%s: addrs=%v, want %v", c.name, h.addrs, c.addrs)
+		}
+	}
+}
+
+func TestRefreshHosts(t *testing.T) {
+	option := &Option{ResolveInterval: 3600}
+	hosts := []Host{{Name: "s1", Addr: "127.0.0.1:1"}, {Name: "s2", Addr: "127.0.0.1:2"}}
+	u := &upstreams{}
+	u.SetOption(option)
+	if err := u.UpdateHosts(option, hosts); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		u.stateMu.Lock()
+		u.startRefresh(&Option{ResolveInterval: -1}, nil, nil)
+		u.stateMu.Unlock()
+	}()
+	table, err := compileRoutes(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u.stateMu.Lock()
+	done := u.refreshDone
+	u.stateMu.Unlock()
+	group := u.allHosts.Load().(*hostGroup)
+	state := group.hosts[0].state
+
+	cases := []struct {
+		name    string
+		hosts   []Host
+		done    chan struct{}
+		applied bool
+	}{
+		{"unchanged", hosts, done, false},
+		{"changed", []Host{{Name: "s1", Addr: "127.0.0.1:1"}, {Name: "s2", Addr: "127.0.0.1:2", Weight: 50}}, done, true},
+		// hosts are updated while resolving
+		{"stale", []Host{{Name: "s1", Addr: "127.0.0.1:1"}}, make(chan struct{}), false},
+	}
+	for _, c := range cases {
+		u.refresh(option, table, c.hosts, c.done)
+		current := u.allHosts.Load().(*hostGroup)
+		if applied := current != group; applied != c.applied {
+			t.Errorf("%s: applied=%v", c.name, applied)
+		}
+		group = current
+	}
+
+	// states of hosts are kept across re-resolving
+	if group.hosts[0].state != state || group.hosts[1].Weight != 50 {
+		t.Errorf("after refresh: %v", group.hosts)
+	}
+}
@@ -0,0 +1,71 @@
+package upstream
+
+import (
+	"errors"
+	"regexp"
+)
+
+// Route routes targetServer to hosts. A route matches targetServer by Pattern,
+// or by Prefix if Pattern is empty; for a prefix route, $1 is the rest of targetServer.
+// Matched hosts are tried in order: Group, Addr, then groups in Fallback.
+type Route struct {
+	Pattern string
+	Prefix  string
+
+	Group    string   // name of host group, capture groups of pattern can be referenced as $1
+	Addr     string   // host:port resolved by dns, capture groups of pattern can be referenced as $1
+	Fallback []string // names of host group to try in order
+
+	re *regexp.Regexp
+}
+
+var errInvalidRoute = errors.New("invalid route")
+
+func (r *Route) compile() error {
+	var err error
+	if r.Pattern != "" {
+		r.re, err = regexp.Compile(r.Pattern)
+	} else if r.Prefix != "" {
+		r.re, err = regexp.Compile("^" + regexp.QuoteMeta(r.Prefix) + "(.*)$")
+	} else {
+		err = errInvalidRoute
+	}
+	if err != nil {
+		return err
+	}
+	if r.Group == "" && r.Addr == "" && len(r.Fallback) == 0 {
+		return errInvalidRoute
+	}
+	return nil
+}
+
+// match returns submatch indexes of name, nil if not matched
+func (r *Route) match(name string) []int {
+	return r.re.FindStringSubmatchIndex(name)
+}
+
+func (r *Route) expand(template string, name string, match []int) string {
+	return string(r.re.ExpandString(nil, template, name, match))
+}
+
+// routeTable is compiled routes and the policy for targetServer matches no host,
+// they're swapped together when hosts are updated
+type routeTable struct {
+	routes        []*Route
+	rejectUnknown bool
+}
+
+func compileRoutes(option *Option) (*routeTable, error) {
+	table := &routeTable{
+		routes:        make([]*Route, 0, len(option.Routes)),
+		rejectUnknown: option.RejectUnknown,
+	}
+	for _, route := range option.Routes {
+		r := route
+		if err := r.compile(); err != nil {
+			return nil, err
+		}
+		table.routes = append(table.routes, &r)
+	}
+	return table, nil
+}
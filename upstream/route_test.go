@@ -0,0 +1,167 @@
+package upstream
+
+import (
+	"testing"
+)
+
+func TestCompileRoutes(t *testing.T) {
+	invalid := [][]Route{
+		{{Group: "g"}},                    // no pattern or prefix
+		{{Prefix: "game-"}},               // no hosts
+		{{Pattern: "game-(", Group: "g"}}, // bad pattern
+		{{Prefix: "a", Group: "g"}, {}},   // any invalid route
+	}
+	for i, routes := range invalid {
+		if _, err := compileRoutes(&Option{Routes: routes}); err == nil {
+			t.Errorf("case %d: invalid routes compiled", i)
+		}
+	}
+
+	table, err := compileRoutes(&Option{Routes: []Route{{Prefix: "a", Addr: "$1:80"}}, RejectUnknown: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table.routes) != 1 || !table.rejectUnknown {
+		t.Errorf("route table: %+v", table)
+	}
+}
+
+func TestRouteMatchExpand(t *testing.T) {
+	cases := []struct {
+		route    Route
+		name     string
+		template string
+		want     string // empty if not matched
+	}{
+		{Route{Prefix: "game-", Group: "g"}, "game-1", "g$1", "g1"},
+		{Route{Prefix: "game-", Group: "g"}, "game-", "g$1", "g"},
+		{Route{Prefix: "game-", Group: "g"}, "xgame-1", "g$1", ""},
+		{Route{Prefix: "a.b", Group: "g"}, "axb1", "g$1", ""}, // prefix is literal
+		{Route{Pattern: `^zone(\d+)\.(\w+)$`, Group: "g"}, "zone3.battle", "$2-$1", "battle-3"},
+		{Route{Pattern: `^zone(\d+)$`, Group: "g"}, "zonex", "$1", ""},
+		{Route{Pattern: `^(\w+)$`, Addr: "a"}, "login", "${1}.svc:1248", "login.svc:1248"},
+	}
+	for i, c := range cases {
+		r := c.route
+		if err := r.compile(); err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		match := r.match(c.name)
+		if match == nil {
+			if c.want != "" {
+				t.Errorf("case %d: %s not matched", i, c.name)
+			}
+			continue
+		}
+		if got := r.expand(c.template, c.name, match); got != c.want {
+			t.Errorf("case %d: expand=%s, want=%s", i, got, c.want)
+		}
+	}
+}
+
+func testRouteUpstreams(t *testing.T, rejectUnknown bool) *upstreams {
+	option := &Option{
+		Routes: []Route{
+			{Prefix: "game-", Group: "g$1", Fallback: []string{"other"}},
+			{Prefix: "down-", Group: "missing"},
+		},
+		RejectUnknown:   rejectUnknown,
+		ResolveInterval: -1,
+	}
+	hosts := []Host{
+		{Name: "g1", Addr: "127.0.0.1:10001"},
+		{Name: "g2", Addr: "127.0.0.1:10002"},
+		{Name: "other", Addr: "127.0.0.1:10003"},
+	}
+	u := &upstreams{}
+	u.SetOption(option)
+	if err := u.UpdateHosts(option, hosts); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestGetHostByRoute(t *testing.T) {
+	u := testRouteUpstreams(t, false)
+
+	cases := []struct {
+		target string
+		want   string // name of host
+	}{
+		{"game-1", "g1"},
+		{"game-2", "g2"},
+		{"game-3", "other"}, // fallback
+		{"g2", "g2"},        // by name
+	}
+	for _, c := range cases {
+		h := u.GetHost(c.target, nil, map[string]bool{})
+		if h == nil || h.Name != c.want {
+			t.Errorf("%s: host=%v, want=%s", c.target, h, c.want)
+		}
+	}
+
+	// the first matched route decides hosts
+	if h := u.GetPreferredHost("down-1", nil, map[string]bool{}); h != nil {
+		t.Errorf("down-1: host=%s, want none", h.Name)
+	}
+
+	// unknown targets fall back to all hosts
+	if h := u.GetHost("unknown", nil, map[string]bool{}); h == nil {
+		t.Errorf("unknown target is rejected")
+	}
+
+	if g := u.GroupOf("game-2"); g != "g2" {
+		t.Errorf("group of game-2: %s", g)
+	}
+	if g := u.GroupOf("other"); g != "other" {
+		t.Errorf("group of other: %s", g)
+	}
+	if g := u.GroupOf("unknown"); g != "" {
+		t.Errorf("group of unknown: %s", g)
+	}
+}
+
+func TestRejectUnknownWithRoutes(t *testing.T) {
+	u := testRouteUpstreams(t, false)
+
+	// reject policy is switched with routes, not by SetOption
+	option := &Option{
+		Routes:          []Route{{Prefix: "game-", Group: "g$1"}},
+		RejectUnknown:   true,
+		ResolveInterval: -1,
+	}
+	if err := u.UpdateHosts(option, []Host{{Name: "g1", Addr: "127.0.0.1:10001"}}); err != nil {
+		t.Fatal(err)
+	}
+	if h := u.GetHost("unknown", nil, map[string]bool{}); h != nil {
+		t.Errorf("unknown target gets host %s", h.Name)
+	}
+	if h := u.GetHost("game-1", nil, map[string]bool{}); h == nil || h.Name != "g1" {
+		t.Errorf("game-1: host=%v", h)
+	}
+	// empty target isn't rejected
+	if h := u.GetHost("", nil, map[string]bool{}); h == nil {
+		t.Errorf("empty target is rejected")
+	}
+}
+
+func TestExcludedGroups(t *testing.T) {
+	u := testRouteUpstreams(t, false)
+	u.SetExcludedGroups([]string{"G1", "other"})
+
+	// random choice skips excluded groups
+	for i := 0; i < 10; i++ {
+		if h := u.GetHost("unknown", nil, map[string]bool{}); h == nil || h.Name != "g2" {
+			t.Fatalf("unknown target: host=%v, want=g2", h)
+		}
+	}
+	// preferred hosts aren't affected
+	if h := u.GetHost("game-1", nil, map[string]bool{}); h == nil || h.Name != "g1" {
+		t.Errorf("game-1: host=%v", h)
+	}
+
+	u.SetExcludedGroups(nil)
+	if h := u.GetHost("", nil, map[string]bool{"g2@127.0.0.1:10002": true}); h == nil {
+		t.Errorf("no host after excluded groups cleared")
+	}
+}
@@ -2,10 +2,14 @@ package upstream
 
 import (
 	"errors"
+	"io"
 	"math/rand"
 	"net"
 	"regexp"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/ejoy/goscon/scp"
 	"github.com/xjdrew/glog"
@@ -16,6 +20,13 @@ var ErrNoHost = errors.New("no host")
 
 const defaultWeight = 100
 
+const (
+	defaultMaxAttempts = 3
+	defaultDialTimeout = 5 * time.Second
+
+	defaultResolveInterval = 30 * time.Second
+)
+
 // ResolveRule describes upstream resolver config
 type ResolveRule struct {
 	// prefix + name + suffix provides the domain name.
@@ -59,10 +70,95 @@ func (r *ResolveRule) Validate(name string) bool {
 	return r.rePattern.MatchString(name)
 }
 
+// GroupOption describes option of hosts with the same name
+type GroupOption struct {
+	Name        string
+	HealthCheck *HealthCheck `mapstructure:"health_check"`
+	Balance     string       // balance strategy, default to Option.Balance
+	HashKey     string       `mapstructure:"hash_key"` // hash key for balance hash
+}
+
 // Option describes upstream option
 type Option struct {
 	Net    string
 	Resolv *ResolveRule
+
+	// default health check for all hosts, nil means disabled
+	HealthCheck *HealthCheck `mapstructure:"health_check"`
+	// default balance strategy, and the strategy to choose from all hosts
+	Balance string
+	HashKey string `mapstructure:"hash_key"`
+	Groups  []GroupOption
+
+	MaxAttempts int `mapstructure:"max_attempts"` // max hosts to try for a new connection
+	DialTimeout int `mapstructure:"dial_timeout"` // seconds, timeout of a single dial
+
+	// passive outlier ejection, nil means disabled
+	OutlierDetection *OutlierDetection `mapstructure:"outlier_detection"`
+
+	// ordered routing table of targetServer
+	Routes []Route
+	// reject targetServer which matches no host, instead of choosing from all hosts
+	RejectUnknown bool `mapstructure:"reject_unknown"`
+
+	// seconds, interval to resolve hosts again, default 30s, negative means disabled
+	ResolveInterval int `mapstructure:"resolve_interval"`
+}
+
+func (o *Option) maxAttempts() int {
+	if o.MaxAttempts <= 0 {
+		return defaultMaxAttempts
+	}
+	return o.MaxAttempts
+}
+
+func (o *Option) resolveInterval() time.Duration {
+	if o.ResolveInterval < 0 {
+		return 0
+	}
+	return seconds(o.ResolveInterval, defaultResolveInterval)
+}
+
+func (o *Option) dialTimeout() time.Duration {
+	if o.DialTimeout <= 0 {
+		return defaultDialTimeout
+	}
+	return time.Duration(o.DialTimeout) * time.Second
+}
+
+func (o *Option) groupOption(name string) *GroupOption {
+	for i := range o.Groups {
+		if o.Groups[i].Name == name {
+			return &o.Groups[i]
+		}
+	}
+	return nil
+}
+
+func (o *Option) balance(name string) (string, string) {
+	if g := o.groupOption(name); g != nil && g.Balance != "" {
+		return g.Balance, g.HashKey
+	}
+	return o.Balance, o.HashKey
+}
+
+func (o *Option) validate() error {
+	if err := validateBalance(o.Balance, o.HashKey); err != nil {
+		return err
+	}
+	for _, g := range o.Groups {
+		if err := validateBalance(g.Balance, g.HashKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *Option) healthCheck(name string) *HealthCheck {
+	if g := o.groupOption(name); g != nil && g.HealthCheck != nil {
+		return g.HealthCheck
+	}
+	return o.HealthCheck
 }
 
 // Host indicates a backend server
@@ -71,12 +167,85 @@ type Host struct {
 	Addr   string
 	Weight int
 
+	// discover hosts by dns srv record, Addr and Weight are taken from srv records
+	SRV string
+
+	// no new connection to host, existing connections continue
+	Drain bool
+
 	addrs []*net.TCPAddr
+	state *hostState
+}
+
+func (h *Host) key() string {
+	return h.Name + "@" + h.Addr
+}
+
+// available reports whether host can be chosen for new connections
+func (h *Host) available() bool {
+	if h.Drain {
+		return false
+	}
+	if h.state == nil {
+		return true
+	}
+	return h.state.isHealthy() && !h.state.isEjected(time.Now().UnixNano())
 }
 
-type hostGroup struct {
-	hosts  []*Host
-	weight int
+// weight returns effective weight, which ramps up while host is in slow start
+func (h *Host) weight() int {
+	if h.state == nil {
+		return h.Weight
+	}
+	w := int64(h.Weight) * h.state.slowStartFactor(time.Now().UnixNano()) / 100
+	if w <= 0 {
+		return 1
+	}
+	return int(w)
+}
+
+// Release is called when the connection to host returned by NewConn is closed,
+// err is the error on upstream side if the pair is ended by upstream.
+// io.EOF is a normal close by upstream, so it's not counted by outlier detection.
+func (h *Host) Release(lifetime time.Duration, err error) {
+	if h.state == nil {
+		return
+	}
+	atomic.AddInt64(&h.state.pairs, -1)
+	if err != nil && err != io.EOF {
+		h.state.onClosed(lifetime)
+	}
+}
+
+// Temporary reports whether host isn't in the host list, e.g. resolved for a target server
+func (h *Host) Temporary() bool {
+	return h.state == nil
+}
+
+// Pairs returns count of live pairs connected to host
+func (h *Host) Pairs() int64 {
+	if h.state == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&h.state.pairs)
+}
+
+func (h *Host) acquire() {
+	if h.state != nil {
+		atomic.AddInt64(&h.state.pairs, 1)
+	}
+}
+
+func (h *Host) onRequest(ok bool) {
+	if h.state != nil {
+		h.state.onRequest(ok)
+	}
+}
+
+func (h *Host) onError() {
+	if h.state != nil {
+		h.state.onError()
+	}
 }
 
 // upstreams 代表后端服务
@@ -85,6 +254,15 @@ type upstreams struct {
 
 	allHosts    atomic.Value // *hostGroup
 	byNameHosts atomic.Value // map[string]*hostGroup
+	routes      atomic.Value // *routeTable
+	peers       atomic.Value // []*hostState, distinct states of all hosts
+	excluded    atomic.Value // map[string]bool, lower case names of groups skipped by GetRandomHost
+
+	// runtime state of hosts, keyed by name and addr, survives UpdateHosts
+	stateMu     sync.Mutex
+	states      map[string]*hostState
+	refreshDone chan struct{} // close to stop re-resolution
+	hosts       []Host        // hosts of last UpdateHosts
 }
 
 // SetOption .
@@ -92,137 +270,276 @@ func (u *upstreams) SetOption(option *Option) {
 	u.option.Store(option)
 }
 
-// reference to the host:port format of `net.Dial`.
-func lookupTCPAddrs(hostport string) ([]*net.TCPAddr, error) {
-	host, service, err := net.SplitHostPort(hostport)
+// UpdateHosts .
+func (u *upstreams) UpdateHosts(option *Option, hosts []Host) error {
+	sz := len(hosts)
+	if option.Resolv == nil && len(option.Routes) == 0 && sz == 0 {
+		return ErrNoHost
+	}
+	if err := option.validate(); err != nil {
+		return err
+	}
+	table, err := compileRoutes(option)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	addrs, err := net.LookupHost(host)
+	resolved, err := resolveHosts(hosts, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	tcpAddrs := make([]*net.TCPAddr, len(addrs))
-	for i, addr := range addrs {
-		addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(addr, service))
-		if err != nil { // only error when lookup port failed
-			return nil, err
+
+	u.stateMu.Lock()
+	defer u.stateMu.Unlock()
+	u.applyHosts(option, table, resolved)
+	u.startRefresh(option, table, hosts)
+	u.hosts = append([]Host(nil), hosts...)
+	return nil
+}
+
+// Hosts returns hosts of last UpdateHosts
+func (u *upstreams) Hosts() []Host {
+	u.stateMu.Lock()
+	defer u.stateMu.Unlock()
+	return append([]Host(nil), u.hosts...)
+}
+
+// HostStatus describes a resolved host and its runtime state
+type HostStatus struct {
+	Name    string   `json:"name"`
+	Addr    string   `json:"addr"`
+	SRV     string   `json:"srv,omitempty"`
+	Weight  int      `json:"weight"`
+	Drain   bool     `json:"drain"`
+	Addrs   []string `json:"addrs"`
+	Healthy bool     `json:"healthy"`
+	Ejected bool     `json:"ejected"`
+	Pairs   int64    `json:"pairs"`
+}
+
+// HostStatuses returns status of all resolved hosts
+func (u *upstreams) HostStatuses() []HostStatus {
+	hosts := u.allHosts.Load().(*hostGroup).hosts
+	now := time.Now().UnixNano()
+	statuses := make([]HostStatus, 0, len(hosts))
+	for _, h := range hosts {
+		addrs := make([]string, len(h.addrs))
+		for i, addr := range h.addrs {
+			addrs[i] = addr.String()
 		}
-		tcpAddrs[i] = addr
+		statuses = append(statuses, HostStatus{
+			Name:    h.Name,
+			Addr:    h.Addr,
+			SRV:     h.SRV,
+			Weight:  h.Weight,
+			Drain:   h.Drain,
+			Addrs:   addrs,
+			Healthy: h.state.isHealthy(),
+			Ejected: h.state.isEjected(now),
+			Pairs:   h.Pairs(),
+		})
 	}
-	return tcpAddrs, nil
+	return statuses
 }
 
-// UpdateHosts .
-func (u *upstreams) UpdateHosts(option *Option, hosts []Host) error {
-	sz := len(hosts)
-	if option.Resolv == nil && sz == 0 {
-		return ErrNoHost
-	}
-	allHosts := new(hostGroup)
-	allHosts.hosts = make([]*Host, 0, sz)
-	allHosts.weight = 0
+// applyHosts builds host groups from resolved hosts and swaps them in, should hold stateMu
+func (u *upstreams) applyHosts(option *Option, table *routeTable, hosts []*Host) {
+	allHosts := newHostGroup(option.Balance, option.HashKey)
+	allHosts.hosts = make([]*Host, 0, len(hosts))
 
+	states := make(map[string]*hostState)
 	byNameHosts := make(map[string]*hostGroup)
-	for _, host := range hosts {
-		h := host
-		addrs, err := lookupTCPAddrs(h.Addr)
-		if err != nil {
-			return err
-		}
-		h.addrs = addrs
-		if h.Weight <= 0 {
-			// set default weight
-			h.Weight = defaultWeight
+	for _, h := range hosts {
+		key := h.key()
+		st := states[key]
+		if st == nil {
+			st = u.states[key]
+			if st == nil {
+				st = newHostState(h.Name, h.Addr)
+			}
+			states[key] = st
 		}
-		allHosts.hosts = append(allHosts.hosts, &h)
-		allHosts.weight = allHosts.weight + h.Weight
+		h.state = st
+
+		allHosts.hosts = append(allHosts.hosts, h)
 
 		if h.Name != "" {
 			hg := byNameHosts[h.Name]
 			if hg == nil {
-				hg = new(hostGroup)
+				hg = newHostGroup(option.balance(h.Name))
 				byNameHosts[h.Name] = hg
 			}
-			hg.hosts = append(hg.hosts, &h)
-			hg.weight = hg.weight + h.Weight
+			hg.hosts = append(hg.hosts, h)
+		}
+	}
+
+	// stop states of removed hosts
+	for key, st := range u.states {
+		if states[key] == nil {
+			st.stop()
 		}
 	}
+	peers := make([]*hostState, 0, len(states))
+	for _, st := range states {
+		peers = append(peers, st)
+	}
+	u.peers.Store(peers)
 
+	// restart health check with new addrs and option
+	for _, h := range allHosts.hosts {
+		h.state.startHealthCheck(h, option.healthCheck(h.Name), option.Net)
+		h.state.setOutlierDetection(option.OutlierDetection, &u.peers)
+	}
+	u.states = states
+
+	allHosts.buildRing()
+	for _, hg := range byNameHosts {
+		hg.buildRing()
+	}
 	u.allHosts.Store(allHosts)
 	u.byNameHosts.Store(byNameHosts)
-	return nil
+	u.routes.Store(table)
 }
 
-func chooseByLocalHosts(group *hostGroup) *Host {
-	if group == nil || len(group.hosts) == 0 {
+// chooseByAddr resolves hostport as a temporary host
+func chooseByAddr(name string, hostport string, tried map[string]bool) *Host {
+	addrs, err := lookupTCPAddrs(hostport)
+	if err != nil {
+		if glog.V(1) {
+			glog.Infof("resolve upstream failed: name=%s, addr=%s, err=%s", name, hostport, err.Error())
+		}
+		return nil
+	}
+	h := &Host{
+		Name:  name,
+		Addr:  hostport,
+		addrs: addrs,
+	}
+	if tried[h.key()] {
 		return nil
 	}
+	return h
+}
 
-	v := rand.Intn(group.weight)
-	for _, host := range group.hosts {
-		if host.Weight >= v {
-			return host
-		}
-		v -= host.Weight
+func chooseByResolver(name string, rule *ResolveRule, tried map[string]bool) *Host {
+	if !rule.Validate(name) {
+		return nil
 	}
-	return nil
+	return chooseByAddr(name, rule.FullName(name), tried)
 }
 
-func chooseByResolver(name string, rule *ResolveRule) *Host {
-	hosts := make([]*Host, 0, 2)
-	if rule.Validate(name) {
-		hostport := rule.FullName(name)
-		addrs, err := lookupTCPAddrs(hostport)
-		if err == nil {
-			h := Host{
-				Name:  name,
-				Addr:  hostport,
-				addrs: addrs,
-			}
-			hosts = append(hosts, &h)
+// chooseByRoute tries group, addr and fallback groups of the matched route in order
+func chooseByRoute(mapHosts map[string]*hostGroup, r *Route, name string, match []int, remote *scp.Conn, tried map[string]bool) *Host {
+	if r.Group != "" {
+		if h := chooseByLocalHosts(mapHosts[r.expand(r.Group, name, match)], remote, tried); h != nil {
+			return h
 		}
 	}
-	lenhosts := len(hosts)
-	if lenhosts == 0 {
-		return nil
+	if r.Addr != "" {
+		if h := chooseByAddr(name, r.expand(r.Addr, name, match), tried); h != nil {
+			return h
+		}
 	}
-	return hosts[rand.Intn(lenhosts)]
+	for _, fallback := range r.Fallback {
+		if h := chooseByLocalHosts(mapHosts[fallback], remote, tried); h != nil {
+			return h
+		}
+	}
+	return nil
 }
 
-// GetPreferedHost choose a host by name, if several hosts have same
-// name then random choose by weight
-func (u *upstreams) GetPreferredHost(name string) *Host {
+// GetPreferedHost choose a host by name. The first matched route decides
+// the hosts, otherwise if several hosts have same name then random choose by weight
+func (u *upstreams) GetPreferredHost(name string, remote *scp.Conn, tried map[string]bool) *Host {
+	return u.getPreferredHost(u.routes.Load().(*routeTable), name, remote, tried)
+}
+
+func (u *upstreams) getPreferredHost(table *routeTable, name string, remote *scp.Conn, tried map[string]bool) *Host {
 	mapHosts := u.byNameHosts.Load().(map[string]*hostGroup)
-	h := chooseByLocalHosts(mapHosts[name])
-	if h != nil {
-		return h
+	for _, r := range table.routes {
+		if match := r.match(name); match != nil {
+			return chooseByRoute(mapHosts, r, name, match, remote, tried)
+		}
 	}
+
+	if group := mapHosts[name]; group != nil {
+		return chooseByLocalHosts(group, remote, tried)
+	}
+	var h *Host
 	option := u.option.Load().(*Option)
 	if option.Resolv != nil {
-		h = chooseByResolver(name, option.Resolv)
+		h = chooseByResolver(name, option.Resolv, tried)
 	}
-	if h == nil {
+	if h == nil && len(tried) == 0 {
 		glog.Errorf("prefered name is malformed, name=%s", name)
 	}
 	return h
 }
 
-// GetRandomHost chooses a host randomly from all hosts.
-func (u *upstreams) GetRandomHost() *Host {
+// GroupOf returns name of host group which targetServer name is routed to, empty if it isn't routed to a group
+func (u *upstreams) GroupOf(name string) string {
+	mapHosts, _ := u.byNameHosts.Load().(map[string]*hostGroup)
+	table, _ := u.routes.Load().(*routeTable)
+	if table == nil {
+		return ""
+	}
+	for _, r := range table.routes {
+		if match := r.match(name); match != nil {
+			if r.Group == "" {
+				return ""
+			}
+			return r.expand(r.Group, name, match)
+		}
+	}
+	if _, ok := mapHosts[name]; ok {
+		return name
+	}
+	return ""
+}
+
+// SetExcludedGroups sets host groups never chosen by GetRandomHost, names are case insensitive
+func (u *upstreams) SetExcludedGroups(groups []string) {
+	excluded := make(map[string]bool, len(groups))
+	for _, name := range groups {
+		excluded[strings.ToLower(name)] = true
+	}
+	u.excluded.Store(excluded)
+}
+
+// GetRandomHost chooses a host randomly from all hosts, except hosts of excluded groups.
+func (u *upstreams) GetRandomHost(remote *scp.Conn, tried map[string]bool) *Host {
 	mapHosts := u.allHosts.Load().(*hostGroup)
-	return chooseByLocalHosts(mapHosts)
+	if excluded, _ := u.excluded.Load().(map[string]bool); len(excluded) > 0 {
+		skipped := make(map[string]bool, len(tried))
+		for k := range tried {
+			skipped[k] = true
+		}
+		for _, h := range mapHosts.hosts {
+			if excluded[strings.ToLower(h.Name)] {
+				skipped[h.key()] = true
+			}
+		}
+		tried = skipped
+	}
+	return chooseByLocalHosts(mapHosts, remote, tried)
 }
 
-// GetHost prefers static hosts map, and will use resolver if config.
+// GetHost prefers routes and static hosts map, and will use resolver if config.
 // When preferred is empty string, GetHost only searches static hosts map.
-func (u *upstreams) GetHost(preferred string) *Host {
+// Hosts in tried are skipped, so that GetHost fails over to other hosts of the
+// preferred group before falling back to all hosts. If option RejectUnknown is set,
+// GetHost never falls back to all hosts for a non-empty preferred name.
+func (u *upstreams) GetHost(preferred string, remote *scp.Conn, tried map[string]bool) *Host {
 	var h *Host
 	if preferred != "" {
-		h = u.GetPreferredHost(preferred)
+		// routes and reject policy of the same update
+		table := u.routes.Load().(*routeTable)
+		h = u.getPreferredHost(table, preferred, remote, tried)
+		if table.rejectUnknown {
+			return h
+		}
 	}
 	if h == nil {
-		h = u.GetRandomHost()
+		h = u.GetRandomHost(remote, tried)
 	}
 	return h
 }
@@ -246,40 +563,116 @@ func upgradeConn(network string, localConn net.Conn, remoteConn *scp.Conn) (conn
 	return
 }
 
-// NewConn creates a new connection to target server, pair with remoteConn
-func (u *upstreams) NewConn(remoteConn *scp.Conn) (conn net.Conn, err error) {
-	tserver := remoteConn.TargetServer()
-	host := u.GetHost(tserver)
-	if host == nil {
-		err = ErrNoHost
-		glog.Errorf("get host <%s> failed: %s", tserver, err.Error())
-		return
+// dial connects to one of the addrs of host
+func dial(host *Host, timeout time.Duration) (conn net.Conn, err error) {
+	n := len(host.addrs)
+	if n == 0 {
+		return nil, errNoAddr
 	}
-
-	rand.Shuffle(len(host.addrs), func(i, j int) { host.addrs[i], host.addrs[j] = host.addrs[j], host.addrs[i] })
-	var tcpConn *net.TCPConn
-	for _, addr := range host.addrs {
-		tcpConn, err = net.DialTCP("tcp", nil, addr)
+	off := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		addr := host.addrs[(off+i)%n]
+		conn, err = net.DialTimeout("tcp", addr.String(), timeout)
 		if err == nil {
 			break
 		}
 	}
+	return
+}
+
+// connect creates a connection to host, and upgrades it as option.Net
+func (u *upstreams) connect(host *Host, remoteConn *scp.Conn, option *Option) (conn net.Conn, err error) {
+	tcpConn, err := dial(host, option.dialTimeout())
 	if err != nil {
+		dialAttempts.WithLabelValues("dial_failed").Inc()
+		host.onRequest(false)
 		glog.Errorf("connect to <%s> failed: %s", host.Addr, err.Error())
 		return
 	}
 
-	option := u.option.Load().(*Option)
 	conn, err = upgradeConn(option.Net, tcpConn, remoteConn)
 	if err != nil {
-		conn.Close()
+		tcpConn.Close()
+		dialAttempts.WithLabelValues("handshake_failed").Inc()
+		host.onRequest(false)
+		return
+	}
+	dialAttempts.WithLabelValues("succeed").Inc()
+	host.onRequest(true)
+	return
+}
+
+// NewConn creates a new connection to target server, pair with remoteConn.
+// Caller should call host.Release when conn is closed.
+func (u *upstreams) NewConn(remoteConn *scp.Conn) (conn net.Conn, host *Host, err error) {
+	tserver := remoteConn.TargetServer()
+	option := u.option.Load().(*Option)
+	tried := make(map[string]bool)
+	for i := 0; i < option.maxAttempts(); i++ {
+		host = u.GetHost(tserver, remoteConn, tried)
+		if host == nil {
+			if i == 0 {
+				err = ErrNoHost
+				glog.Errorf("get host <%s> failed: %s", tserver, err.Error())
+			}
+			break
+		}
+		tried[host.key()] = true
+
+		if i > 0 {
+			dialRetries.Inc()
+			if glog.V(1) {
+				glog.Infof("upstream retry: target=%s, host=%s, addr=%s, attempt=%d", tserver, host.Name, host.Addr, i+1)
+			}
+		}
+
+		conn, err = u.connect(host, remoteConn, option)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
 		return
 	}
 
-	err = OnAfterConnected(conn, remoteConn)
+	if err = OnAfterConnected(conn, remoteConn); err != nil {
+		glog.Errorf("upstream hook failed: target=%s, host=%s, err=%s", tserver, host.Addr, err.Error())
+		host.onError()
+		conn.Close()
+		conn = nil
+		return
+	}
+	host.acquire()
 	return
 }
 
+// AttachHost finds host by name and addr for a connection created by another process.
+// Caller should call host.Release when conn is closed.
+func (u *upstreams) AttachHost(name string, addr string) *Host {
+	key := name + "@" + addr
+	for _, host := range u.allHosts.Load().(*hostGroup).hosts {
+		if host.key() == key {
+			host.acquire()
+			return host
+		}
+	}
+	// host is removed, pairs are not tracked
+	return &Host{Name: name, Addr: addr}
+}
+
+// Ejections .
+func (u *upstreams) Ejections() []*Ejection {
+	u.stateMu.Lock()
+	defer u.stateMu.Unlock()
+	ejections := make([]*Ejection, 0)
+	for _, st := range u.states {
+		if e := st.ejection(); e != nil {
+			ejections = append(ejections, e)
+		}
+	}
+	return ejections
+}
+
 var defaultUpstreams upstreams
 
 // SetOption sets option
@@ -292,7 +685,42 @@ func UpdateHosts(option *Option, hosts []Host) error {
 	return defaultUpstreams.UpdateHosts(option, hosts)
 }
 
+// SetHosts refresh backend hosts list with current option
+func SetHosts(hosts []Host) error {
+	return defaultUpstreams.UpdateHosts(defaultUpstreams.option.Load().(*Option), hosts)
+}
+
+// Hosts returns backend hosts list
+func Hosts() []Host {
+	return defaultUpstreams.Hosts()
+}
+
+// HostStatuses returns status of resolved backend hosts
+func HostStatuses() []HostStatus {
+	return defaultUpstreams.HostStatuses()
+}
+
 // NewConn create a new connection, pair with remoteConn
-func NewConn(remoteConn *scp.Conn) (conn net.Conn, err error) {
+func NewConn(remoteConn *scp.Conn) (conn net.Conn, host *Host, err error) {
 	return defaultUpstreams.NewConn(remoteConn)
 }
+
+// GroupOf returns name of host group which targetServer name is routed to
+func GroupOf(name string) string {
+	return defaultUpstreams.GroupOf(name)
+}
+
+// SetExcludedGroups sets host groups never chosen for targets falling back to all hosts
+func SetExcludedGroups(groups []string) {
+	defaultUpstreams.SetExcludedGroups(groups)
+}
+
+// AttachHost finds host of a connection handed over by another process
+func AttachHost(name string, addr string) *Host {
+	return defaultUpstreams.AttachHost(name, addr)
+}
+
+// Ejections returns hosts ejected by outlier detection, including hosts in slow start
+func Ejections() []*Ejection {
+	return defaultUpstreams.Ejections()
+}
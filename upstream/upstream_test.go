@@ -0,0 +1,128 @@
+package upstream
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/ejoy/goscon/scp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func counterValue(c interface {
+	Write(*dto.Metric) error
+}) int {
+	var m dto.Metric
+	c.Write(&m)
+	return int(m.GetCounter().GetValue())
+}
+
+type dialCounters struct {
+	failed, succeed, retries int
+}
+
+func readDialCounters() dialCounters {
+	return dialCounters{
+		failed:  counterValue(dialAttempts.WithLabelValues("dial_failed")),
+		succeed: counterValue(dialAttempts.WithLabelValues("succeed")),
+		retries: counterValue(dialRetries),
+	}
+}
+
+// closedAddr returns an address nobody listens on
+func closedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestNewConnFailover(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	c, _ := net.Pipe()
+	defer c.Close()
+	remote := scp.Restore(c, &scp.Config{}, &scp.State{})
+
+	cases := []struct {
+		failed      int // hosts refusing connections
+		maxAttempts int
+		ok          bool
+		attempts    int // failed attempts, without succeed one
+	}{
+		// all failed hosts are tried before the good one at most, each only once
+		{failed: 2, maxAttempts: 3, ok: true},
+		{failed: 4, maxAttempts: 5, ok: true},
+		// attempts are limited
+		{failed: 3, maxAttempts: 2, ok: false, attempts: 2},
+		// no more hosts to try
+		{failed: 2, maxAttempts: 5, ok: false, attempts: 2},
+	}
+	for i, c := range cases {
+		var hosts []Host
+		for j := 0; j < c.failed; j++ {
+			hosts = append(hosts, Host{Name: "bad" + strconv.Itoa(j), Addr: closedAddr(t)})
+		}
+		if c.ok {
+			hosts = append(hosts, Host{Name: "good", Addr: l.Addr().String()})
+		}
+		option := &Option{MaxAttempts: c.maxAttempts, ResolveInterval: -1}
+		u := &upstreams{}
+		u.SetOption(option)
+		if err := u.UpdateHosts(option, hosts); err != nil {
+			t.Fatalf("case %d: UpdateHosts: %s", i, err.Error())
+		}
+
+		// random choice, try many times
+		failovers := 0
+		for n := 0; n < 20; n++ {
+			before := readDialCounters()
+			conn, host, err := u.NewConn(remote)
+			after := readDialCounters()
+			failed, retries := after.failed-before.failed, after.retries-before.retries
+			if !c.ok {
+				if err == nil {
+					t.Fatalf("case %d: connected to %s", i, host.Name)
+				}
+				if failed != c.attempts || retries != c.attempts-1 {
+					t.Fatalf("case %d: failed=%d, retries=%d", i, failed, retries)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("case %d: NewConn: %s", i, err.Error())
+			}
+			conn.Close()
+			host.Release(0, nil)
+			if host.Name != "good" {
+				t.Fatalf("case %d: connected to %s", i, host.Name)
+			}
+			// every failed attempt is followed by a retry to another host
+			if failed > c.failed || retries != failed || after.succeed-before.succeed != 1 {
+				t.Fatalf("case %d: failed=%d, retries=%d, succeed=%d", i, failed, retries, after.succeed-before.succeed)
+			}
+			if failed > 0 {
+				failovers++
+			}
+		}
+		if c.ok && failovers == 0 {
+			t.Errorf("case %d: bad hosts never chosen first", i)
+		}
+	}
+}
@@ -1,9 +1,19 @@
 package main
 
 import (
+	"net"
 	"runtime"
 )
 
+// ipOf returns host part of addr
+func ipOf(addr net.Addr) string {
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return ip
+}
+
 // stacks is a wrapper for runtime.Stack that attempts to recover the data for all goroutines.
 func stacks(all bool) []byte {
 	// We don't know how big the traces are, so grow a few times if they don't fit. Start large, though.